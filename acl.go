@@ -0,0 +1,287 @@
+package tt
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gregoryv/mq"
+)
+
+// Authorizer decides which topics a connected client may use.
+type Authorizer interface {
+	// Authorize returns mq.Success to allow access to the topic or
+	// a reason code >= 0x80, e.g. mq.NotAuthorized. For AccessRead
+	// topic is a subscription filter and for AccessWrite a topic
+	// name.
+	Authorize(ctx context.Context, v *ConnectInfo, access Access, topic string) mq.ReasonCode
+}
+
+// Access is the kind of topic access a client requests.
+type Access uint8
+
+const (
+	AccessRead  Access = 1 << iota // subscribe
+	AccessWrite                    // publish
+
+	AccessReadWrite = AccessRead | AccessWrite
+)
+
+func (a Access) String() string {
+	switch a {
+	case AccessRead:
+		return "read"
+	case AccessWrite:
+		return "write"
+	case AccessReadWrite:
+		return "readwrite"
+	}
+	return fmt.Sprintf("Access(%d)", uint8(a))
+}
+
+// ----------------------------------------
+
+// LoadACLFile returns an authorizer using the given mosquitto style
+// acl file.
+func LoadACLFile(filename string) (*ACL, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	var acl ACL
+	if err := acl.Load(fh); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return &acl, nil
+}
+
+// ACL authorizes clients using rules of the format
+//
+//	# comment
+//	topic [read|write|readwrite|deny] TOPIC
+//	user USERNAME
+//	pattern [read|write|readwrite|deny] TOPIC
+//
+// Access defaults to readwrite. Topic rules before the first user
+// line apply to clients without username, thereafter to the named
+// user. Pattern rules apply to all clients with %c replaced by the
+// client ID and %u by the username. Rules may use wildcards, a
+// subscription filter is allowed only if covered by a rule, e.g. the
+// rule a/# covers filter a/+/b but a/+ does not cover a/#. A matching
+// deny rule overrides any allowing rule, for subscriptions it's enough
+// that the filter overlaps the denied topic.
+type ACL struct {
+	m         sync.RWMutex
+	anonymous []aclRule
+	users     map[string][]aclRule
+	patterns  []aclRule
+}
+
+type aclRule struct {
+	access Access
+	deny   bool
+	topic  string
+}
+
+// Load replaces all rules with those read from r.
+func (a *ACL) Load(r io.Reader) error {
+	var (
+		anonymous []aclRule
+		users     = make(map[string][]aclRule)
+		patterns  []aclRule
+		user      *string
+	)
+	s := bufio.NewScanner(r)
+	var lineno int
+	for s.Scan() {
+		lineno++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		keyword, rest, _ := strings.Cut(line, " ")
+		rest = strings.TrimSpace(rest)
+		switch keyword {
+		case "user":
+			if rest == "" {
+				return fmt.Errorf("line %v: %w: missing username", lineno, ErrACLRule)
+			}
+			user = &rest
+
+		case "topic", "pattern":
+			rule, err := parseACLRule(rest)
+			if err != nil {
+				return fmt.Errorf("line %v: %w", lineno, err)
+			}
+			switch {
+			case keyword == "pattern":
+				patterns = append(patterns, rule)
+			case user == nil:
+				anonymous = append(anonymous, rule)
+			default:
+				users[*user] = append(users[*user], rule)
+			}
+
+		default:
+			return fmt.Errorf("line %v: %w: %q", lineno, ErrACLRule, keyword)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	a.m.Lock()
+	a.anonymous = anonymous
+	a.users = users
+	a.patterns = patterns
+	a.m.Unlock()
+	return nil
+}
+
+var ErrACLRule = fmt.Errorf("bad acl rule")
+
+func parseACLRule(v string) (aclRule, error) {
+	rule := aclRule{access: AccessReadWrite, topic: v}
+	if kind, topic, found := strings.Cut(v, " "); found {
+		rule.topic = strings.TrimSpace(topic)
+		switch kind {
+		case "read":
+			rule.access = AccessRead
+		case "write":
+			rule.access = AccessWrite
+		case "readwrite":
+		case "deny":
+			rule.deny = true
+		default:
+			// topic containing spaces
+			rule.topic = v
+		}
+	}
+	if err := parseTopicFilter(rule.topic); err != nil {
+		return rule, fmt.Errorf("%w: %v", ErrACLRule, err)
+	}
+	return rule, nil
+}
+
+// Authorize returns mq.Success if a rule allows the access and no
+// deny rule matches, mq.NotAuthorized otherwise.
+func (a *ACL) Authorize(_ context.Context, v *ConnectInfo, access Access, topic string) mq.ReasonCode {
+	a.m.RLock()
+	defer a.m.RUnlock()
+
+	rules := a.anonymous
+	if v.Username != "" {
+		rules = a.users[v.Username]
+	}
+	var allowed bool
+	check := func(rule aclRule) (deny bool) {
+		if rule.deny {
+			return aclOverlaps(rule.topic, topic)
+		}
+		if rule.access&access != 0 && aclCovers(rule.topic, topic) {
+			allowed = true
+		}
+		return false
+	}
+	for _, rule := range rules {
+		if check(rule) {
+			return mq.NotAuthorized
+		}
+	}
+	for _, rule := range a.patterns {
+		topic, ok := substitute(rule.topic, v)
+		if !ok {
+			continue
+		}
+		rule.topic = topic
+		if check(rule) {
+			return mq.NotAuthorized
+		}
+	}
+	if !allowed {
+		return mq.NotAuthorized
+	}
+	return mq.Success
+}
+
+// substitute replaces %c and %u in pattern. Returns false if a
+// required value is empty or contains wildcards or levels.
+func substitute(pattern string, v *ConnectInfo) (string, bool) {
+	for _, r := range []struct {
+		key, value string
+	}{
+		{"%c", v.ClientID},
+		{"%u", v.Username},
+	} {
+		if !strings.Contains(pattern, r.key) {
+			continue
+		}
+		if r.value == "" || strings.ContainsAny(r.value, "+#/") {
+			return "", false
+		}
+		pattern = strings.ReplaceAll(pattern, r.key, r.value)
+	}
+	return pattern, true
+}
+
+// aclCovers returns true if the rule topic matches the topic name or
+// covers the subscription filter, i.e. wildcards in the filter are
+// only covered by wildcards in the rule.
+func aclCovers(rule, topic string) bool {
+	ruleLevels := strings.Split(rule, "/")
+	levels := strings.Split(topic, "/")
+	// 4.7.2 wildcards do not match topics starting with $
+	if strings.HasPrefix(levels[0], "$") && (ruleLevels[0] == "+" || ruleLevels[0] == "#") {
+		return false
+	}
+	for i, r := range ruleLevels {
+		if r == "#" {
+			return true
+		}
+		if i == len(levels) {
+			return false
+		}
+		switch {
+		case r == "+":
+			if levels[i] == "#" {
+				return false
+			}
+		case r != levels[i]:
+			return false
+		}
+	}
+	return len(levels) == len(ruleLevels)
+}
+
+// aclOverlaps returns true if any topic name matches both the rule
+// and the topic, which may be a filter.
+func aclOverlaps(rule, topic string) bool {
+	a := strings.Split(rule, "/")
+	b := strings.Split(topic, "/")
+	if strings.HasPrefix(a[0], "$") != strings.HasPrefix(b[0], "$") {
+		// only wildcards could differ, 4.7.2 they never match $
+		return false
+	}
+	for i := 0; i < len(a) && i < len(b); i++ {
+		switch {
+		case a[i] == "#" || b[i] == "#":
+			return true
+		case a[i] == "+" || b[i] == "+":
+		case a[i] != b[i]:
+			return false
+		}
+	}
+	switch {
+	case len(a) == len(b):
+		return true
+	case len(a) == len(b)+1:
+		return a[len(b)] == "#"
+	case len(b) == len(a)+1:
+		return b[len(a)] == "#"
+	}
+	return false
+}
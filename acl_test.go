@@ -0,0 +1,131 @@
+package tt
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/gregoryv/mq"
+)
+
+func TestACL(t *testing.T) {
+	var acl ACL
+	err := acl.Load(strings.NewReader(`# anonymous
+topic read public/#
+
+pattern readwrite clients/%c/#
+pattern write users/%u/status
+
+user gopher
+topic gopher/#
+topic deny gopher/secret
+topic read sport/+/score
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	anonymous := &ConnectInfo{ClientID: "pink"}
+	gopher := &ConnectInfo{ClientID: "blue", Username: "gopher"}
+	cases := []struct {
+		v      *ConnectInfo
+		access Access
+		topic  string
+		exp    mq.ReasonCode
+	}{
+		{anonymous, AccessRead, "public/news", mq.Success},
+		{anonymous, AccessRead, "public/#", mq.Success},
+		{anonymous, AccessRead, "public", mq.Success},
+		{anonymous, AccessWrite, "public/news", mq.NotAuthorized},
+		{anonymous, AccessRead, "#", mq.NotAuthorized},
+		{anonymous, AccessRead, "publicity", mq.NotAuthorized},
+		{anonymous, AccessWrite, "clients/pink/a", mq.Success},
+		{anonymous, AccessWrite, "clients/blue/a", mq.NotAuthorized},
+		{anonymous, AccessWrite, "users//status", mq.NotAuthorized},
+
+		{gopher, AccessRead, "public/news", mq.NotAuthorized},
+		{gopher, AccessWrite, "gopher/a/b", mq.Success},
+		{gopher, AccessRead, "gopher/a/+", mq.Success},
+		{gopher, AccessWrite, "gopher/secret", mq.NotAuthorized},
+		{gopher, AccessRead, "gopher/#", mq.NotAuthorized}, // overlaps secret
+		{gopher, AccessRead, "+/secret", mq.NotAuthorized},
+		{gopher, AccessRead, "sport/tennis/score", mq.Success},
+		{gopher, AccessRead, "sport/+/score", mq.Success},
+		{gopher, AccessRead, "sport/#", mq.NotAuthorized},
+		{gopher, AccessWrite, "sport/tennis/score", mq.NotAuthorized},
+		{gopher, AccessWrite, "users/gopher/status", mq.Success},
+		{gopher, AccessRead, "users/gopher/status", mq.NotAuthorized},
+		{gopher, AccessWrite, "clients/blue/x", mq.Success},
+	}
+	ctx := context.Background()
+	for _, c := range cases {
+		got := acl.Authorize(ctx, c.v, c.access, c.topic)
+		if got != c.exp {
+			t.Errorf("%s %v %s: got %v, expected %v",
+				c.v.ClientID, c.access, c.topic, got, c.exp,
+			)
+		}
+	}
+}
+
+func TestACL_Load(t *testing.T) {
+	bad := []string{
+		"user",
+		"group admins",
+		"topic read a/#/b",
+		"pattern",
+	}
+	for _, line := range bad {
+		var acl ACL
+		if err := acl.Load(strings.NewReader(line)); err == nil {
+			t.Errorf("%q loaded", line)
+		}
+	}
+	if _, err := LoadACLFile("no/such/file"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestServer_Authorize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	var acl ACL
+	acl.Load(strings.NewReader("topic allowed/#"))
+	s.SetAuthorizer(&acl)
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	conn := pipeConn(ctx, s)
+	t.Cleanup(func() { conn.Close() })
+	c := mq.NewConnect()
+	c.SetClientID("pink")
+	c.WriteTo(conn)
+	_, _ = mq.ReadPacket(conn)
+
+	{ // per filter reason codes
+		p := mq.NewSubscribe()
+		p.SetPacketID(1)
+		p.AddFilters(
+			mq.NewTopicFilter("allowed/a", mq.OptQoS1),
+			mq.NewTopicFilter("denied/a", mq.OptQoS1),
+		)
+		p.WriteTo(conn)
+		a, _ := mq.ReadPacket(conn)
+		codes := a.(*mq.SubAck).ReasonCodes()
+		if len(codes) != 2 || codes[0] != uint8(mq.GrantedQoS1) || codes[1] != uint8(mq.NotAuthorized) {
+			t.Error("unexpected", codes)
+		}
+		if s.router.Subscribed("pink", "denied/a") {
+			t.Error("denied filter subscribed")
+		}
+	}
+	{ // denied publish
+		p := mq.Pub(1, "denied/a", "x")
+		p.SetPacketID(2)
+		p.WriteTo(conn)
+		a, _ := mq.ReadPacket(conn)
+		if a, ok := a.(*mq.PubAck); !ok || a.ReasonCode() != mq.NotAuthorized {
+			t.Error("expected NotAuthorized, got", a)
+		}
+	}
+}
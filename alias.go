@@ -0,0 +1,89 @@
+package tt
+
+import (
+	"container/list"
+
+	"github.com/gregoryv/mq"
+)
+
+// topicAliases maps aliases to topic names of incoming publish
+// packets on one connection. Not safe for concurrent use.
+//
+// See 3.3.2.3.4 Topic Alias
+type topicAliases struct {
+	max   uint16
+	names map[uint16]string
+}
+
+// resolve sets the topic name of p, if it uses an alias, and removes
+// the alias. Returns a reason code >= 0x80 if p is invalid.
+func (a *topicAliases) resolve(p *mq.Publish) mq.ReasonCode {
+	alias := p.TopicAlias()
+	switch {
+	case alias == 0:
+		return mq.Success
+
+	case alias > a.max:
+		return mq.TopicAliasInvalid
+
+	case p.TopicName() == "":
+		name, found := a.names[alias]
+		if !found {
+			return mq.ProtocolError
+		}
+		p.SetTopicName(name)
+
+	default:
+		if a.names == nil {
+			a.names = make(map[uint16]string)
+		}
+		a.names[alias] = p.TopicName()
+	}
+	p.SetTopicAlias(0)
+	return mq.Success
+}
+
+// ----------------------------------------
+
+func newAliasLRU(max uint16) *aliasLRU {
+	return &aliasLRU{
+		max:    max,
+		order:  list.New(),
+		byName: make(map[string]*list.Element),
+	}
+}
+
+// aliasLRU assigns aliases to topic names of outgoing publish
+// packets, reusing the alias of the least recently used topic once
+// all are taken. Not safe for concurrent use.
+type aliasLRU struct {
+	max    uint16
+	order  *list.List // most recently used first
+	byName map[string]*list.Element
+}
+
+type aliasEntry struct {
+	name  string
+	alias uint16
+}
+
+// assign returns the alias for the topic name and true if the
+// receiver already knows it.
+func (a *aliasLRU) assign(name string) (uint16, bool) {
+	if e, found := a.byName[name]; found {
+		a.order.MoveToFront(e)
+		return e.Value.(*aliasEntry).alias, true
+	}
+	if a.order.Len() < int(a.max) {
+		v := &aliasEntry{name: name, alias: uint16(a.order.Len() + 1)}
+		a.byName[name] = a.order.PushFront(v)
+		return v.alias, false
+	}
+	e := a.order.Back()
+	v := e.Value.(*aliasEntry)
+	delete(a.byName, v.name)
+	v.name = name
+	a.byName[name] = e
+	a.order.MoveToFront(e)
+	return v.alias, false
+}
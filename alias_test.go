@@ -0,0 +1,152 @@
+package tt
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gregoryv/mq"
+)
+
+func Test_topicAliases(t *testing.T) {
+	a := topicAliases{max: 2}
+	pub := func(name string, alias uint16) *mq.Publish {
+		p := mq.Pub(0, name, "")
+		p.SetTopicAlias(alias)
+		return p
+	}
+	cases := []struct {
+		p    *mq.Publish
+		exp  mq.ReasonCode
+		name string
+	}{
+		{pub("a/b", 0), mq.Success, "a/b"},
+		{pub("", 0), mq.Success, ""}, // left for WellFormed
+		{pub("", 1), mq.ProtocolError, ""},
+		{pub("a/b", 1), mq.Success, "a/b"},
+		{pub("", 1), mq.Success, "a/b"},
+		{pub("c", 1), mq.Success, "c"},
+		{pub("", 1), mq.Success, "c"},
+		{pub("a/b", 3), mq.TopicAliasInvalid, "a/b"},
+	}
+	for i, c := range cases {
+		code := a.resolve(c.p)
+		if code != c.exp || c.p.TopicName() != c.name {
+			t.Errorf("case %v: got %v %q", i, code, c.p.TopicName())
+		}
+		if code == mq.Success && c.p.TopicAlias() != 0 {
+			t.Errorf("case %v: alias not removed", i)
+		}
+	}
+}
+
+func Test_aliasLRU(t *testing.T) {
+	a := newAliasLRU(2)
+	for i, c := range []struct {
+		name  string
+		alias uint16
+		known bool
+	}{
+		{"a", 1, false},
+		{"b", 2, false},
+		{"a", 1, true},
+		{"c", 2, false}, // b is least recently used
+		{"a", 1, true},
+		{"b", 2, false},
+	} {
+		alias, known := a.assign(c.name)
+		if alias != c.alias || known != c.known {
+			t.Errorf("case %v: %s got %v %v", i, c.name, alias, known)
+		}
+	}
+}
+
+func TestServer_TopicAlias(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	s.SetTopicAliasMax(1)
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	sub := pipeConn(ctx, s)
+	t.Cleanup(func() { sub.Close() })
+	c := mq.NewConnect()
+	c.SetTopicAliasMax(1)
+	c.WriteTo(sub)
+	a, _ := mq.ReadPacket(sub)
+	if v := a.(*mq.ConnAck).TopicAliasMax(); v != 1 {
+		t.Fatal("expected Topic Alias Maximum 1 got", v)
+	}
+	{
+		p := mq.NewSubscribe()
+		p.SetPacketID(1)
+		p.AddFilters(mq.NewTopicFilter("#", 0))
+		p.WriteTo(sub)
+		_, _ = mq.ReadPacket(sub)
+	}
+
+	pub := pipeConn(ctx, s)
+	t.Cleanup(func() { pub.Close() })
+	mq.NewConnect().WriteTo(pub)
+	_, _ = mq.ReadPacket(pub)
+	for _, v := range []struct {
+		name  string
+		alias uint16
+	}{
+		{"long/topic/name", 1},
+		{"", 1},
+		{"other", 0},
+	} {
+		p := mq.Pub(0, v.name, "hi")
+		p.SetTopicAlias(v.alias)
+		p.WriteTo(pub)
+	}
+
+	// subscriber gets aliases of its own
+	for i, exp := range []string{"long/topic/name", "", "other"} {
+		p, _ := mq.ReadPacket(sub)
+		v, ok := p.(*mq.Publish)
+		if !ok || v.TopicName() != exp || v.TopicAlias() != 1 {
+			t.Errorf("message %v: expected %q with alias 1 got %v", i, exp, p)
+		}
+	}
+
+	p := mq.Pub(0, "a", "hi")
+	p.SetTopicAlias(2)
+	p.WriteTo(pub)
+	d, _ := mq.ReadPacket(pub)
+	if d, ok := d.(*mq.Disconnect); !ok || d.ReasonCode() != mq.TopicAliasInvalid {
+		t.Error("expected TopicAliasInvalid got", d)
+	}
+}
+
+// Outgoing aliases are limited by the server.
+func TestServer_OutTopicAliasMax(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	s.SetOutTopicAliasMax(0)
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	conn := pipeConn(ctx, s)
+	t.Cleanup(func() { conn.Close() })
+	c := mq.NewConnect()
+	c.SetTopicAliasMax(10)
+	c.WriteTo(conn)
+	_, _ = mq.ReadPacket(conn)
+	{
+		p := mq.NewSubscribe()
+		p.SetPacketID(1)
+		p.AddFilters(mq.NewTopicFilter("a/b", 0))
+		p.WriteTo(conn)
+		_, _ = mq.ReadPacket(conn)
+	}
+	for i := 0; i < 2; i++ {
+		go s.publish(ctx, mq.Pub(0, "a/b", "hi"))
+		p, _ := mq.ReadPacket(conn)
+		if v, ok := p.(*mq.Publish); !ok || v.TopicName() != "a/b" || v.TopicAlias() != 0 {
+			t.Error("expected a/b without alias got", p)
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package arn
 
+import "sort"
+
 // NewNode returns a new node using txt as level value. E.g. +, # or a
 // word.
 func NewNode(txt string) *Node {
@@ -12,39 +14,43 @@ type Node struct {
 	// Value is controlled by the caller.
 	Value any
 
-	txt      string
-	parent   *Node
-	children []*Node
-}
+	txt    string
+	parent *Node
 
-func (n *Node) match(result *[]*Node, parts []string, i int) {
-	lastPart := len(parts)-1 == i
-	switch {
-	case i > len(parts)-1:
-		*result = append(*result, n)
-		return
+	// children by level text, wildcards are kept separately
+	children map[string]*Node
+	plus     *Node
+	hash     *Node
+
+	// true if a filter ends at this node
+	filter bool
+}
 
-	case n.txt == "#":
-		if len(parts[0]) == 0 || parts[0][0] != '$' {
-			// https://docs.oasis-open.org/mqtt/mqtt/v5.0/os/mqtt-v5.0-os.html#_Toc3901246
+// match appends filter nodes among the descendants of n matching the
+// topic name parts, where n matched the level before parts[0].
+// Wildcards at the first level are excluded by the caller for topic
+// names starting with $.
+func (n *Node) match(result *[]*Node, parts []string) {
+	if len(parts) == 0 {
+		if n.filter {
 			*result = append(*result, n)
 		}
-		return
-
-	case lastPart && n.txt == "+":
-		*result = append(*result, n)
-		return
-
-	case lastPart && n.txt == parts[i] && n.IsLeaf():
-		*result = append(*result, n)
-		return
-
-	case n.txt != "+" && n.txt != parts[i]:
+		// multi-level wildcard also matches the parent level,
+		// i.e. a/# matches a
+		if n.hash != nil && n.hash.filter {
+			*result = append(*result, n.hash)
+		}
 		return
 	}
-
-	for _, child := range n.children {
-		child.match(result, parts, i+1)
+	// https://docs.oasis-open.org/mqtt/mqtt/v5.0/os/mqtt-v5.0-os.html#_Toc3901244
+	if n.hash != nil && n.hash.filter {
+		*result = append(*result, n.hash)
+	}
+	if n.plus != nil {
+		n.plus.match(result, parts[1:])
+	}
+	if c, found := n.children[parts[0]]; found {
+		c.match(result, parts[1:])
 	}
 }
 
@@ -60,17 +66,80 @@ func (n *Node) Find(parts []string) (*Node, bool) {
 }
 
 func (n *Node) FindChild(txt string) *Node {
-	for _, child := range n.children {
-		if child.txt == txt {
-			return child
-		}
+	switch txt {
+	case "+":
+		return n.plus
+	case "#":
+		return n.hash
 	}
-	return nil
+	return n.children[txt]
 }
 
+// AddChild adds c replacing any child with the same level text.
 func (n *Node) AddChild(c *Node) {
 	c.parent = n
-	n.children = append(n.children, c)
+	switch c.txt {
+	case "+":
+		n.plus = c
+	case "#":
+		n.hash = c
+	default:
+		if n.children == nil {
+			n.children = make(map[string]*Node)
+		}
+		n.children[c.txt] = c
+	}
+}
+
+func (n *Node) removeChild(c *Node) {
+	switch {
+	case n.plus == c:
+		n.plus = nil
+	case n.hash == c:
+		n.hash = nil
+	case n.children[c.txt] == c:
+		delete(n.children, c.txt)
+	}
+}
+
+// eachChild calls fn for each child, wildcards first followed by
+// children sorted by level text.
+func (n *Node) eachChild(fn func(*Node)) {
+	if n.hash != nil {
+		fn(n.hash)
+	}
+	if n.plus != nil {
+		fn(n.plus)
+	}
+	txt := make([]string, 0, len(n.children))
+	for k := range n.children {
+		txt = append(txt, k)
+	}
+	sort.Strings(txt)
+	for _, k := range txt {
+		fn(n.children[k])
+	}
+}
+
+// remove unmarks the filter of the given parts and removes nodes no
+// longer leading to a filter. Returns false if no such filter exists.
+func (n *Node) remove(parts []string) bool {
+	if len(parts) == 0 {
+		if !n.filter {
+			return false
+		}
+		n.filter = false
+		n.Value = nil
+		return true
+	}
+	c := n.FindChild(parts[0])
+	if c == nil || !c.remove(parts[1:]) {
+		return false
+	}
+	if !c.filter && c.IsLeaf() {
+		n.removeChild(c)
+	}
+	return true
 }
 
 func (n *Node) Filter() string {
@@ -80,18 +149,18 @@ func (n *Node) Filter() string {
 	return n.parent.Filter() + "/" + n.txt
 }
 
+// Leafs returns all descendant nodes where a filter ends.
 func (n *Node) Leafs() []*Node {
 	var leafs []*Node
-	for _, c := range n.children {
-		if c.IsLeaf() {
+	n.eachChild(func(c *Node) {
+		if c.filter {
 			leafs = append(leafs, c)
-			continue
 		}
 		leafs = append(leafs, c.Leafs()...)
-	}
+	})
 	return leafs
 }
 
 func (n *Node) IsLeaf() bool {
-	return len(n.children) == 0
+	return len(n.children) == 0 && n.plus == nil && n.hash == nil
 }
@@ -8,10 +8,12 @@ package arn
 
 import (
 	"strings"
+	"sync"
 )
 
-// NewTree returns a new empty topic filter tree. Methods are Not
-// safe to call from multiple go routines.
+// NewTree returns a new empty topic filter tree. Methods are safe to
+// call from multiple go routines, though node values are controlled
+// by the caller.
 func NewTree(filters ...string) *Tree {
 	tree := &Tree{
 		root: NewNode(""),
@@ -23,25 +25,35 @@ func NewTree(filters ...string) *Tree {
 }
 
 type Tree struct {
+	m    sync.RWMutex
 	root *Node
 }
 
+// Modify calls mod with the node of the given filter, if found.
 func (t *Tree) Modify(filter string, mod func(*Node)) {
-	parts := strings.Split(filter, "/")
-	n, found := t.root.Find(parts)
+	t.m.Lock()
+	defer t.m.Unlock()
+	n, found := t.find(filter)
 	if !found {
 		return
 	}
 	mod(n)
 }
 
-// Match populates result with leaf nodes matching the given topic
+// Match populates result with filter nodes matching the given topic
 // name.
 func (t *Tree) Match(result *[]*Node, topic string) {
+	t.m.RLock()
+	defer t.m.RUnlock()
 	parts := strings.Split(topic, "/")
-	for _, child := range t.root.children {
-		child.match(result, parts, 0)
+	// https://docs.oasis-open.org/mqtt/mqtt/v5.0/os/mqtt-v5.0-os.html#_Toc3901246
+	if strings.HasPrefix(topic, "$") {
+		if c, found := t.root.children[parts[0]]; found {
+			c.match(result, parts[1:])
+		}
+		return
 	}
+	t.root.match(result, parts)
 }
 
 // Filters returns all topic filters in the tree
@@ -55,6 +67,8 @@ func (t *Tree) Filters() []string {
 
 // Leafs returns all topic filters in the tree as nodes.
 func (t *Tree) Leafs() []*Node {
+	t.m.RLock()
+	defer t.m.RUnlock()
 	return t.root.Leafs()
 }
 
@@ -62,20 +76,40 @@ func (t *Tree) Leafs() []*Node {
 // new node for that filter. Returns nil on empty filter.
 // Argument filter must be a valid filter.
 func (t *Tree) AddFilter(filter string) *Node {
+	if filter == "" {
+		return nil
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
 	parts := strings.Split(filter, "/")
 	n := t.addParts(t.root, parts)
-	// t.root is just a virtual parent
-	for _, top := range t.root.children {
-		top.parent = nil
-	}
+	n.filter = true
 	return n
 }
 
+// RemoveFilter removes the topic filter and its value from the
+// tree. Returns false if not found.
+func (t *Tree) RemoveFilter(filter string) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.root.remove(strings.Split(filter, "/"))
+}
+
 // Find returns node matching the given filter. If not found, nil and
 // false is returned.
 func (t *Tree) Find(filter string) (*Node, bool) {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return t.find(filter)
+}
+
+func (t *Tree) find(filter string) (*Node, bool) {
 	parts := strings.Split(filter, "/")
-	return t.root.Find(parts)
+	n, found := t.root.Find(parts)
+	if !found || !n.filter {
+		return nil, false
+	}
+	return n, true
 }
 
 func (t *Tree) addParts(n *Node, parts []string) *Node {
@@ -86,6 +120,10 @@ func (t *Tree) addParts(n *Node, parts []string) *Node {
 	if parent == nil {
 		parent = NewNode(parts[0])
 		n.AddChild(parent)
+		if n == t.root {
+			// t.root is just a virtual parent
+			parent.parent = nil
+		}
 	}
 	// add rest
 	return t.addParts(parent, parts[1:])
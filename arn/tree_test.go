@@ -18,12 +18,74 @@ package arn
 
 import (
 	"bytes"
+	"fmt"
 	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/gregoryv/golden"
+	"github.com/gregoryv/tt/spec"
 )
 
+func TestTree_Match(t *testing.T) {
+	match := func(filter, name string) bool {
+		var result []*Node
+		NewTree(filter).Match(&result, name)
+		return len(result) == 1
+	}
+	if err := spec.VerifyFilterMatching(match); err != nil {
+		t.Errorf("\n%v", err)
+	}
+}
+
+// Filters ending at inner nodes match, e.g. a and a/b.
+func TestTree_MatchInner(t *testing.T) {
+	x := NewTree("a/b", "a", "a/#")
+	var result []*Node
+	x.Match(&result, "a")
+	if len(result) != 2 {
+		t.Error("a should match a and a/#, got", result)
+	}
+}
+
+func TestTree_RemoveFilter(t *testing.T) {
+	x := NewTree("a/b/c", "a", "x/#")
+	if x.RemoveFilter("a/b") {
+		t.Error("removed inner node a/b")
+	}
+	if !x.RemoveFilter("a/b/c") || !x.RemoveFilter("x/#") {
+		t.Error("RemoveFilter failed", x.Filters())
+	}
+	if v := x.Filters(); !reflect.DeepEqual(v, []string{"a"}) {
+		t.Error("unexpected filters", v)
+	}
+	if n := x.root.FindChild("a"); n == nil || !n.IsLeaf() {
+		t.Error("empty nodes not removed")
+	}
+	if x.RemoveFilter("a/b/c") {
+		t.Error("removed twice")
+	}
+}
+
+func TestTree_concurrent(t *testing.T) {
+	x := NewTree()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var result []*Node
+			for j := 0; j < 100; j++ {
+				filter := fmt.Sprintf("a/%v/#", j)
+				x.AddFilter(filter)
+				x.Match(&result, "a/1/b")
+				x.RemoveFilter(filter)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
 func TestTree_MatchMiddlePlus(t *testing.T) {
 	filter := "gopher/+/hat"
 	x := NewTree(filter)
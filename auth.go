@@ -0,0 +1,100 @@
+package tt
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"slices"
+
+	"github.com/gregoryv/mq"
+)
+
+// Authenticator decides if a client may connect.
+type Authenticator interface {
+	// Authenticate returns mq.Success to accept the client or a
+	// ConnAck reason code >= 0x80, e.g. mq.BadUserNameOrPassword or
+	// mq.NotAuthorized, to reject it.
+	Authenticate(ctx context.Context, v *ConnectInfo) mq.ReasonCode
+}
+
+// AuthenticatorFunc adapts a func to the Authenticator interface.
+type AuthenticatorFunc func(context.Context, *ConnectInfo) mq.ReasonCode
+
+func (fn AuthenticatorFunc) Authenticate(ctx context.Context, v *ConnectInfo) mq.ReasonCode {
+	return fn(ctx, v)
+}
+
+// ConnectInfo describes a connecting client.
+type ConnectInfo struct {
+	// as sent by client or assigned by server
+	ClientID string
+
+	Username string
+	Password []byte
+
+	RemoteAddr net.Addr
+
+	// from the connect packet
+	UserProperties []mq.UserProp
+
+	// empty unless enhanced authentication is used
+	AuthMethod string
+
+	// verified client certificate of tls connections, nil if none.
+	// E.g. use Certificate.Subject.CommonName to identify devices.
+	Certificate *x509.Certificate
+
+	// credentials of the local process connected over a unix socket,
+	// nil for other connections or if not supported by the platform
+	PeerCred *PeerCred
+}
+
+// newConnectInfo returns info describing the connect packet p
+// received on sc.
+func newConnectInfo(sc *sclient, p *mq.Connect) *ConnectInfo {
+	return &ConnectInfo{
+		ClientID:       sc.clientID,
+		Username:       p.Username(),
+		Password:       p.Password(),
+		RemoteAddr:     sc.conn.RemoteAddr(),
+		UserProperties: p.UserProperties,
+		AuthMethod:     p.AuthMethod(),
+		Certificate:    peerCertificate(sc.conn),
+		PeerCred:       peerCred(sc.conn),
+	}
+}
+
+// public returns a copy of v without the password.
+func (v *ConnectInfo) public() *ConnectInfo {
+	c := *v
+	c.Password = nil
+	c.UserProperties = slices.Clone(v.UserProperties)
+	if v.PeerCred != nil {
+		cred := *v.PeerCred
+		c.PeerCred = &cred
+	}
+	return &c
+}
+
+// AuthMethod implements a server side enhanced authentication method,
+// e.g. SCRAM-SHA-256. See 4.12 Enhanced authentication.
+type AuthMethod interface {
+	// Name of the method as sent in the Authentication Method
+	// property.
+	Name() string
+
+	// Start returns a new exchange for the connecting or
+	// re-authenticating client. The exchange may update v, e.g. set
+	// the authenticated username.
+	Start(ctx context.Context, v *ConnectInfo) AuthExchange
+}
+
+// AuthExchange is one, possibly multi step, authentication of a
+// client.
+type AuthExchange interface {
+	// Next is called with authentication data from the client and
+	// returns data for the client with mq.ContinueAuth to continue
+	// the exchange, mq.Success when done or a reason code >= 0x80
+	// to reject the client.
+	Next(ctx context.Context, data []byte) ([]byte, mq.ReasonCode)
+}
@@ -0,0 +1,66 @@
+package tt
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gregoryv/mq"
+)
+
+func TestServer_Authenticate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	var got *ConnectInfo
+	s.SetAuthenticator(AuthenticatorFunc(
+		func(_ context.Context, v *ConnectInfo) mq.ReasonCode {
+			got = v
+			if v.Username != "gopher" || string(v.Password) != "secret" {
+				return mq.BadUserNameOrPassword
+			}
+			return mq.Success
+		},
+	))
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	connect := func(username, password string) *mq.ConnAck {
+		t.Helper()
+		conn := pipeConn(ctx, s)
+		t.Cleanup(func() { conn.Close() })
+		p := mq.NewConnect()
+		p.SetClientID("pink")
+		p.SetUsername(username)
+		p.SetPassword([]byte(password))
+		p.AddUserProp("color", "pink")
+		p.WriteTo(conn)
+		a, err := mq.ReadPacket(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a.(*mq.ConnAck)
+	}
+
+	if a := connect("gopher", "wrong"); a.ReasonCode() != mq.BadUserNameOrPassword {
+		t.Error("expected rejection, got", a)
+	}
+	if s.sessions.Len() != 0 {
+		t.Error("rejected client got a session")
+	}
+	if a := connect("gopher", "secret"); a.ReasonCode() != mq.Success {
+		t.Error("expected success, got", a)
+	}
+	if got.ClientID != "pink" || got.RemoteAddr == nil || len(got.UserProperties) != 1 {
+		t.Errorf("incomplete %+v", got)
+	}
+
+	// connected clients are described without password
+	v, _ := s.Connected("pink")
+	if v.Username != "gopher" || v.Password != nil {
+		t.Errorf("unexpected %+v", v)
+	}
+	v.Username = "changed"
+	if v, _ := s.Connected("pink"); v.Username != "gopher" {
+		t.Error("Connected returned shared info")
+	}
+}
@@ -45,6 +45,9 @@ type Client struct {
 
 	app chan interface{}
 
+	// optional enhanced authentication
+	authMethod ClientAuthMethod
+
 	// synchronize Send
 	m sync.Mutex
 }
@@ -54,6 +57,26 @@ func (c *Client) SetDebug(v bool)         { c.debug = v }
 func (c *Client) SetMaxPacketID(v uint16) { c.maxPacketID = v }
 func (c *Client) SetLogger(v *log.Logger) { c.log = v }
 
+// SetAuthMethod enables enhanced authentication, the method name and
+// initial data are set on the Connect packet when sent.
+func (c *Client) SetAuthMethod(v ClientAuthMethod) { c.authMethod = v }
+
+// ClientAuthMethod implements the client side of an enhanced
+// authentication method, see 4.12 Enhanced authentication.
+type ClientAuthMethod interface {
+	// Name of the method as sent in the Authentication Method
+	// property.
+	Name() string
+
+	// Start returns authentication data for a new exchange.
+	Start() ([]byte, error)
+
+	// Next returns the response to authentication data from the
+	// server. It's also called with the data of the final ConnAck or
+	// Auth packet so the method can verify the server.
+	Next(data []byte) ([]byte, error)
+}
+
 func (c *Client) Run(ctx context.Context) error {
 	err := c.run(ctx)
 	c.app <- event.ClientStop{err}
@@ -108,6 +131,14 @@ func (c *Client) run(ctx context.Context) error {
 			if v := p.KeepAlive(); v > 0 {
 				ping.SetInterval(v)
 			}
+			if m := c.authMethod; m != nil {
+				data, err := m.Start()
+				if err != nil {
+					return err
+				}
+				p.SetAuthMethod(m.Name())
+				p.SetAuthData(data)
+			}
 		}
 
 		// log just before sending
@@ -144,14 +175,29 @@ func (c *Client) run(ctx context.Context) error {
 			}
 		}
 
-		// reuse packet id
-		if p, ok := p.(mq.HasPacketID); ok {
-			_ = pool.reuse(p.PacketID())
+		// reuse packet id once the server acknowledged it, ids of
+		// packets from the server are not part of the pool
+		switch p := p.(type) {
+		case *mq.PubAck, *mq.PubComp, *mq.SubAck, *mq.UnsubAck:
+			_ = pool.reuse(p.(mq.HasPacketID).PacketID())
 		}
 
 		switch p := p.(type) {
+		case *mq.Auth:
+			c.authenticate(ctx, transmit, p)
+
 		case *mq.ConnAck:
 			code := p.ReasonCode()
+			if code == mq.Success && c.authMethod != nil {
+				// verify the server, e.g. SCRAM server signature
+				if _, err := c.authMethod.Next(p.AuthData()); err != nil {
+					c.log.Print(err)
+					code = mq.NotAuthorized
+					d := mq.NewDisconnect()
+					d.SetReasonCode(code)
+					_ = transmit(ctx, d)
+				}
+			}
 			switch {
 			case code == mq.Success:
 				c.app <- event.ClientConnect(0)
@@ -173,9 +219,17 @@ func (c *Client) run(ctx context.Context) error {
 				ack := mq.NewPubAck()
 				ack.SetPacketID(p.PacketID())
 				_ = transmit(ctx, ack)
-			case 2: // ack is done in PubRec
+			case 2:
+				rec := mq.NewPubRec()
+				rec.SetPacketID(p.PacketID())
+				_ = transmit(ctx, rec)
 			}
 
+		case *mq.PubRel:
+			comp := mq.NewPubComp()
+			comp.SetPacketID(p.PacketID())
+			_ = transmit(ctx, comp)
+
 		case *mq.PubRec:
 			// todo what if the application layer doesn't want to
 			// release a packet based on the PubRec reason
@@ -193,6 +247,52 @@ func (c *Client) run(ctx context.Context) error {
 	return recv.Run(ctx)
 }
 
+// authenticate continues an enhanced authentication exchange.
+func (c *Client) authenticate(ctx context.Context, transmit errHandler, p *mq.Auth) {
+	if c.authMethod == nil {
+		d := mq.NewDisconnect()
+		d.SetReasonCode(mq.ProtocolError)
+		_ = transmit(ctx, d)
+		return
+	}
+	data, err := c.authMethod.Next(p.AuthData())
+	if err != nil {
+		c.log.Print(err)
+		d := mq.NewDisconnect()
+		d.SetReasonCode(mq.NotAuthorized)
+		_ = transmit(ctx, d)
+		return
+	}
+	if p.ReasonCode() != mq.ContinueAuth {
+		// re-authentication is done
+		return
+	}
+	a := mq.NewAuth()
+	a.SetReasonCode(mq.ContinueAuth)
+	a.SetAuthMethod(c.authMethod.Name())
+	a.SetAuthData(data)
+	_ = transmit(ctx, a)
+}
+
+// Reauthenticate starts a new enhanced authentication exchange on an
+// established connection, see 4.12.1 Re-authentication.
+func (c *Client) Reauthenticate(ctx context.Context) error {
+	if c.authMethod == nil {
+		return ErrNoAuthMethod
+	}
+	data, err := c.authMethod.Start()
+	if err != nil {
+		return err
+	}
+	a := mq.NewAuth()
+	a.SetReasonCode(mq.ReAuthenticate)
+	a.SetAuthMethod(c.authMethod.Name())
+	a.SetAuthData(data)
+	return c.Send(ctx, a)
+}
+
+var ErrNoAuthMethod = fmt.Errorf("no auth method")
+
 // Send returns when the packet was successfully encoded on the wire.
 // Returns ErrClientStopped if not running. Send is safe to call
 // concurrently.
@@ -320,7 +420,12 @@ func (k *keepAlive) SetInterval(v uint16) {
 }
 
 func (k *keepAlive) delay() {
-	k.packetSent <- struct{}{}
+	// non blocking as packets, e.g. Auth, may be sent before the
+	// ping routine is started
+	select {
+	case k.packetSent <- struct{}{}:
+	default:
+	}
 }
 
 func (k *keepAlive) run(ctx context.Context, transmit errHandler) {
@@ -0,0 +1,63 @@
+package tt
+
+import (
+	"sort"
+	"sync"
+)
+
+func newClients() *clients {
+	return &clients{
+		byID: make(map[string]*sclient),
+	}
+}
+
+// clients keeps connected clients by client ID. Safe for concurrent
+// use.
+type clients struct {
+	m    sync.RWMutex
+	byID map[string]*sclient
+}
+
+// Register sc as the connected client for its client ID. Returns any
+// previously connected client with the same ID.
+func (c *clients) Register(sc *sclient) (old *sclient) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	old = c.byID[sc.clientID]
+	c.byID[sc.clientID] = sc
+	return old
+}
+
+// Unregister sc unless another connection took over.
+func (c *clients) Unregister(sc *sclient) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.byID[sc.clientID] == sc {
+		delete(c.byID, sc.clientID)
+	}
+}
+
+func (c *clients) Get(clientID string) (*sclient, bool) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	sc, found := c.byID[clientID]
+	return sc, found
+}
+
+// IDs returns sorted client IDs.
+func (c *clients) IDs() []string {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	ids := make([]string, 0, len(c.byID))
+	for id := range c.byID {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (c *clients) Len() int {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return len(c.byID)
+}
@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"time"
 
 	"github.com/gregoryv/cmdline"
@@ -229,20 +230,93 @@ type SrvCmd struct {
 	shared opts
 	tt.Bind
 	ConnectTimeout time.Duration
+	StoreFile      string
+	PasswordFile   string
+	ACLFile        string
+	SocketMode     string
+	MaxKeepAlive   uint16
+	MaxQueued      int
+	ReceiveMax     uint16
+	MaxPacketSize  uint32
+	TopicAliasMax  uint16
+	OutAliasMax    uint16
+	SysInterval    time.Duration
+	Overflow       string
 }
 
 func (c *SrvCmd) ExtraOptions(cli *cmdline.Parser) {
 	c.Bind.URL = cli.Option("-b, --bind-tcp, $TT_BIND_TCP").Url("tcp://localhost:").String()
 	c.Bind.AcceptTimeout = cli.Option("-a, --accept-timeout").Duration("500ms").String()
+	c.Bind.CertFile = cli.Option("--tls-cert", "PEM file, required for tls:// binds").String("")
+	c.Bind.KeyFile = cli.Option("--tls-key", "PEM file, required for tls:// binds").String("")
+	c.Bind.ClientCAFile = cli.Option("--tls-ca", "PEM file, clients must present a certificate signed by it").String("")
+	c.SocketMode = cli.Option("--socket-mode", "octal permissions of unix:// socket file").String("0660")
 	c.ConnectTimeout = cli.Option("--connect-timeout").Duration("200ms")
+	c.MaxKeepAlive = cli.Option("--max-keep-alive", "seconds, 0 means no limit").Uint16(0)
+	c.ReceiveMax = cli.Option("--receive-max", "incoming QoS 2 messages in flight per client").Uint16(65535)
+	c.MaxPacketSize = uint32(cli.Option("--max-packet-size", "bytes, 0 means no limit").Int(0))
+	c.TopicAliasMax = cli.Option("--topic-alias-max", "incoming per client, 0 disables topic aliases").Uint16(10)
+	c.OutAliasMax = cli.Option("--out-topic-alias-max", "outgoing per client, 0 disables topic aliases").Uint16(10)
+	c.SysInterval = cli.Option("--sys-interval", "publish $SYS/broker/... statistics, 0 disables").Duration("0s")
+	c.MaxQueued = cli.Option("--max-queued", "outgoing messages per client, 0 means no limit").Int(1000)
+	c.Overflow = cli.Option("--overflow", "when queue is full").Enum(
+		tt.OverflowDropNewest.String(),
+		tt.OverflowDropNewest.String(),
+		tt.OverflowDropOldest.String(),
+		tt.OverflowDisconnect.String(),
+	)
+	c.StoreFile = cli.Option("--store-file", "empty keeps state in memory").String("")
+	c.PasswordFile = cli.Option("--password-file", "mosquitto style, empty allows all").String("")
+	c.ACLFile = cli.Option("--acl-file", "mosquitto style, empty allows all").String("")
 }
 
 func (c *SrvCmd) Run(ctx context.Context) error {
 	srv := tt.NewServer()
 	srv.SetDebug(c.shared.Debug)
 	srv.SetConnectTimeout(c.ConnectTimeout)
+	srv.SetMaxKeepAlive(c.MaxKeepAlive)
+	srv.SetMaxQueued(c.MaxQueued)
+	srv.SetReceiveMax(c.ReceiveMax)
+	srv.SetMaxPacketSize(c.MaxPacketSize)
+	srv.SetTopicAliasMax(c.TopicAliasMax)
+	srv.SetOutTopicAliasMax(c.OutAliasMax)
+	srv.SetSysInterval(c.SysInterval)
+	for _, v := range []tt.Overflow{
+		tt.OverflowDropNewest, tt.OverflowDropOldest, tt.OverflowDisconnect,
+	} {
+		if v.String() == c.Overflow {
+			srv.SetOverflow(v)
+		}
+	}
+	mode, err := strconv.ParseUint(c.SocketMode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("--socket-mode: %w", err)
+	}
+	c.Bind.SocketMode = os.FileMode(mode)
 	srv.AddBind(&c.Bind)
 	srv.SetLogger(log.New(os.Stderr, "ttsrv ", log.Flags()))
+	if c.StoreFile != "" {
+		store, err := tt.OpenFileStore(c.StoreFile)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		srv.SetStore(store)
+	}
+	if c.PasswordFile != "" {
+		pf, err := tt.LoadPasswordFile(c.PasswordFile)
+		if err != nil {
+			return err
+		}
+		srv.SetAuthenticator(pf)
+	}
+	if c.ACLFile != "" {
+		acl, err := tt.LoadACLFile(c.ACLFile)
+		if err != nil {
+			return err
+		}
+		srv.SetAuthorizer(acl)
+	}
 	ctx, cancel := context.WithCancel(ctx)
 	go srv.Run(ctx)
 
@@ -16,10 +16,11 @@ func TestCommands(t *testing.T) {
 
 	runCmd(t, exec.Command("tt", "pub", "-s", url))
 	runCmd(t, exec.Command("tt", "pub", "-q", "1", "-s", url))
+	runCmd(t, exec.Command("tt", "pub", "-q", "2", "-s", url))
 
 	// following should fail
 	notRun(t, exec.Command("tt", "badcmd"))
-	notRun(t, exec.Command("tt", "pub", "-q", "2", "-s", url)) // should fail
+	notRun(t, exec.Command("tt", "pub", "-q", "3", "-s", url)) // should fail
 }
 
 func startCmd(t *testing.T, cmd *exec.Cmd) {
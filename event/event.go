@@ -28,3 +28,19 @@ type ServerUp uint8
 type ServerStop struct {
 	Err error
 }
+
+// ServerRejectConn indicates the server closed a client connection
+// before or while connecting, e.g. due to connect timeout. Connections
+// not sending Connect first or in time are closed without any
+// response.
+type ServerRejectConn struct {
+	Remote string
+	Err    error
+}
+
+// ServerDropMessage indicates the server dropped an outgoing message
+// because the queue of a slow client was full.
+type ServerDropMessage struct {
+	ClientID  string
+	TopicName string
+}
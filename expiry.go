@@ -0,0 +1,46 @@
+package tt
+
+import (
+	"math"
+	"time"
+
+	"github.com/gregoryv/mq"
+)
+
+// expiresAt returns when p expires, zero time if it has no Message
+// Expiry Interval.
+//
+// See 3.3.2.3.3 Message Expiry Interval
+func expiresAt(p *mq.Publish) time.Time {
+	v := p.MessageExpiryInterval()
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(v) * time.Second)
+}
+
+// remaining returns p with the Message Expiry Interval set to the
+// seconds left until expires, as a copy if changed. Returns false if
+// p has expired.
+func remaining(p *mq.Publish, expires time.Time) (*mq.Publish, bool) {
+	if expires.IsZero() {
+		return p, true
+	}
+	left := time.Until(expires)
+	if left <= 0 {
+		return nil, false
+	}
+	// rounded up as zero means the message never expires
+	v := uint32(math.Ceil(left.Seconds()))
+	if v == p.MessageExpiryInterval() {
+		return p, true
+	}
+	p = copyPublish(p)
+	p.SetMessageExpiryInterval(v)
+	return p, true
+}
+
+// expired returns true if the expiry time has passed.
+func expired(expires time.Time) bool {
+	return !expires.IsZero() && !time.Now().Before(expires)
+}
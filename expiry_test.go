@@ -0,0 +1,168 @@
+package tt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gregoryv/mq"
+)
+
+func Test_remaining(t *testing.T) {
+	p := mq.Pub(0, "a", "")
+	if v, ok := remaining(p, time.Time{}); !ok || v != p {
+		t.Error("never expiring message changed")
+	}
+
+	p.SetMessageExpiryInterval(10)
+	v, ok := remaining(p, time.Now().Add(3500*time.Millisecond))
+	if !ok || v.MessageExpiryInterval() != 4 {
+		t.Error("expected 4 seconds left got", v.MessageExpiryInterval())
+	}
+	if p.MessageExpiryInterval() != 10 {
+		t.Error("original modified")
+	}
+
+	if _, ok := remaining(p, time.Now().Add(-time.Millisecond)); ok {
+		t.Error("expired message remains")
+	}
+}
+
+// Expired retained and offline messages are not delivered.
+func TestServer_MessageExpiry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	connect := func(id string) (net.Conn, *mq.ConnAck) {
+		conn := pipeConn(ctx, s)
+		t.Cleanup(func() { conn.Close() })
+		p := mq.NewConnect()
+		p.SetClientID(id)
+		p.SetSessionExpiryInterval(10)
+		p.WriteTo(conn)
+		a, _ := mq.ReadPacket(conn)
+		return conn, a.(*mq.ConnAck)
+	}
+	subscribe := func(conn net.Conn, filter string) {
+		p := mq.NewSubscribe()
+		p.SetPacketID(1)
+		p.AddFilters(mq.NewTopicFilter(filter, mq.OptQoS1))
+		p.WriteTo(conn)
+		_, _ = mq.ReadPacket(conn)
+	}
+	gw, _ := connect("gateway")
+	subscribe(gw, "a/+")
+	gw.Close()
+
+	pub, _ := connect("pub")
+	for i, v := range []struct {
+		name   string
+		expiry uint32
+	}{
+		{"a/short", 1},
+		{"a/long", 10},
+	} {
+		p := mq.Pub(1, v.name, "hi")
+		p.SetPacketID(uint16(i + 1))
+		p.SetRetain(true)
+		p.SetMessageExpiryInterval(v.expiry)
+		p.WriteTo(pub)
+		_, _ = mq.ReadPacket(pub) // PubAck
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	expectLong := func(conn net.Conn) {
+		t.Helper()
+		p, _ := mq.ReadPacket(conn)
+		v, ok := p.(*mq.Publish)
+		if !ok || v.TopicName() != "a/long" {
+			t.Fatal("expected a/long got", p)
+		}
+		if e := v.MessageExpiryInterval(); e != 9 {
+			t.Error("expected remaining expiry 9 got", e)
+		}
+		ack := mq.NewPubAck()
+		ack.SetPacketID(v.PacketID())
+		ack.WriteTo(conn)
+		mq.NewPingReq().WriteTo(conn)
+		if p, _ := mq.ReadPacket(conn); !isPingResp(p) {
+			t.Error("expected only a/long got", p)
+		}
+	}
+	// offline session
+	gw, _ = connect("gateway")
+	expectLong(gw)
+
+	// retained
+	sub, _ := connect("sub")
+	subscribe(sub, "a/+")
+	expectLong(sub)
+}
+
+// Expired messages in the store are not restored.
+func TestServer_RestoreExpired(t *testing.T) {
+	store := NewMemStore()
+	past := time.Now().Add(-time.Second)
+	{
+		p := mq.Pub(0, "a/old", "hi")
+		p.SetMessageExpiryInterval(60)
+		store.SaveRetained(StoredRetained{Publish: p, Expires: past})
+	}
+	{
+		p := mq.Pub(0, "a/new", "hi")
+		p.SetMessageExpiryInterval(60)
+		store.SaveRetained(StoredRetained{
+			Publish: p, Expires: time.Now().Add(10 * time.Second),
+		})
+	}
+	store.SaveSession("gateway", 60)
+	store.SaveSubscription("gateway", StoredSubscription{
+		Filter: "a/+", Options: mq.OptQoS1,
+	})
+	{
+		p := mq.Pub(1, "a/old", "hi")
+		p.SetPacketID(1)
+		store.SaveMessage("gateway", StoredMessage{Publish: p, Expires: past})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	s.SetStore(store)
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	snap, _ := store.Load()
+	if len(snap.Retained) != 1 || len(snap.Sessions[0].Messages) != 0 {
+		t.Error("expired messages remain in store")
+	}
+
+	conn := pipeConn(ctx, s)
+	t.Cleanup(func() { conn.Close() })
+	p := mq.NewConnect()
+	p.SetClientID("gateway")
+	p.WriteTo(conn)
+	_, _ = mq.ReadPacket(conn)
+	{ // expired message is not resent
+		mq.NewPingReq().WriteTo(conn)
+		p, _ := mq.ReadPacket(conn)
+		if !isPingResp(p) {
+			t.Error("expected PingResp got", p)
+		}
+	}
+	{ // retained with remaining expiry
+		p := mq.NewSubscribe()
+		p.SetPacketID(1)
+		p.AddFilters(mq.NewTopicFilter("a/+", 0))
+		p.WriteTo(conn)
+		_, _ = mq.ReadPacket(conn) // SubAck
+	}
+	r, _ := mq.ReadPacket(conn)
+	if r, ok := r.(*mq.Publish); !ok || r.TopicName() != "a/new" || r.MessageExpiryInterval() != 10 {
+		t.Error("expected a/new with expiry 10 got", r)
+	}
+}
@@ -0,0 +1,323 @@
+package tt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// OpenFileStore returns a store which appends all changes to the
+// given file, creating it if needed. Existing records are loaded and
+// the file is compacted.
+func OpenFileStore(filename string) (*FileStore, error) {
+	s := &FileStore{
+		filename:   filename,
+		mem:        NewMemStore(),
+		minCompact: 1000,
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// FileStore keeps state in memory and persists it in an append-only
+// log file. The log is compacted once the number of records written
+// exceeds twice the live state.
+type FileStore struct {
+	filename string
+
+	// current state
+	mem *MemStore
+
+	m    sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+
+	// records written since last compaction
+	written int
+	// compact when written exceeds this
+	compactAt int
+	// lower limit of compactAt
+	minCompact int
+}
+
+// fileRecord is one change in the log.
+type fileRecord struct {
+	Op       string              `json:"op"`
+	ClientID string              `json:"c,omitempty"`
+	Expiry   uint32              `json:"e,omitempty"`
+	Sub      *StoredSubscription `json:"s,omitempty"`
+	Filter   string              `json:"f,omitempty"`
+	PacketID uint16              `json:"i,omitempty"`
+	Sent     bool                `json:"n,omitempty"`
+	Released bool                `json:"r,omitempty"`
+	Topic    string              `json:"t,omitempty"`
+	Packet   []byte              `json:"p,omitempty"`
+
+	// absolute Message Expiry, nil if the message never expires
+	Expires *time.Time `json:"x,omitempty"`
+}
+
+func expiresRecord(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (r *fileRecord) expires() time.Time {
+	if r.Expires == nil {
+		return time.Time{}
+	}
+	return *r.Expires
+}
+
+const (
+	opSession            = "session"
+	opRemoveSession      = "-session"
+	opSubscription       = "sub"
+	opRemoveSubscription = "-sub"
+	opMessage            = "msg"
+	opRemoveMessage      = "-msg"
+	opRetained           = "retain"
+	opRemoveRetained     = "-retain"
+)
+
+func (s *FileStore) SaveSession(clientID string, expiryInterval uint32) error {
+	return s.write(fileRecord{Op: opSession, ClientID: clientID, Expiry: expiryInterval})
+}
+
+func (s *FileStore) RemoveSession(clientID string) error {
+	return s.write(fileRecord{Op: opRemoveSession, ClientID: clientID})
+}
+
+func (s *FileStore) SaveSubscription(clientID string, v StoredSubscription) error {
+	return s.write(fileRecord{Op: opSubscription, ClientID: clientID, Sub: &v})
+}
+
+func (s *FileStore) RemoveSubscription(clientID, filter string) error {
+	return s.write(fileRecord{Op: opRemoveSubscription, ClientID: clientID, Filter: filter})
+}
+
+func (s *FileStore) SaveMessage(clientID string, v StoredMessage) error {
+	return s.write(fileRecord{
+		Op:       opMessage,
+		ClientID: clientID,
+		Sent:     v.Sent,
+		Released: v.Released,
+		Packet:   encode(v.Publish),
+		Expires:  expiresRecord(v.Expires),
+	})
+}
+
+func (s *FileStore) RemoveMessage(clientID string, packetID uint16) error {
+	return s.write(fileRecord{Op: opRemoveMessage, ClientID: clientID, PacketID: packetID})
+}
+
+func (s *FileStore) SaveRetained(v StoredRetained) error {
+	return s.write(fileRecord{
+		Op:      opRetained,
+		Packet:  encode(v.Publish),
+		Expires: expiresRecord(v.Expires),
+	})
+}
+
+func (s *FileStore) RemoveRetained(topicName string) error {
+	return s.write(fileRecord{Op: opRemoveRetained, Topic: topicName})
+}
+
+func (s *FileStore) Load() (*Snapshot, error) {
+	return s.mem.Load()
+}
+
+// Close syncs and closes the underlying file.
+func (s *FileStore) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// write applies the record and appends it to the log.
+func (s *FileStore) write(r fileRecord) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := s.apply(r); err != nil {
+		return err
+	}
+	if err := s.enc.Encode(r); err != nil {
+		return err
+	}
+	s.written++
+	if s.written > s.compactAt {
+		return s.compactLocked()
+	}
+	return nil
+}
+
+// apply record to the in memory state.
+func (s *FileStore) apply(r fileRecord) error {
+	switch r.Op {
+	case opSession:
+		return s.mem.SaveSession(r.ClientID, r.Expiry)
+
+	case opRemoveSession:
+		return s.mem.RemoveSession(r.ClientID)
+
+	case opSubscription:
+		if r.Sub == nil {
+			return ErrBadRecord
+		}
+		return s.mem.SaveSubscription(r.ClientID, *r.Sub)
+
+	case opRemoveSubscription:
+		return s.mem.RemoveSubscription(r.ClientID, r.Filter)
+
+	case opMessage:
+		p, err := decode(r.Packet)
+		if err != nil {
+			return err
+		}
+		return s.mem.SaveMessage(r.ClientID, StoredMessage{
+			Publish:  p,
+			Sent:     r.Sent,
+			Released: r.Released,
+			Expires:  r.expires(),
+		})
+
+	case opRemoveMessage:
+		return s.mem.RemoveMessage(r.ClientID, r.PacketID)
+
+	case opRetained:
+		p, err := decode(r.Packet)
+		if err != nil {
+			return err
+		}
+		return s.mem.SaveRetained(StoredRetained{
+			Publish: p,
+			Expires: r.expires(),
+		})
+
+	case opRemoveRetained:
+		return s.mem.RemoveRetained(r.Topic)
+	}
+	return ErrBadRecord
+}
+
+// replay loads existing records from file. A partially written last
+// record is ignored.
+func (s *FileStore) replay() error {
+	fh, err := os.Open(s.filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	dec := json.NewDecoder(fh)
+	for {
+		var r fileRecord
+		err := dec.Decode(&r)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.apply(r); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *FileStore) compact() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.compactLocked()
+}
+
+// compactLocked rewrites the log with only the live state, caller
+// must hold the lock.
+func (s *FileStore) compactLocked() error {
+	snap, err := s.mem.Load()
+	if err != nil {
+		return err
+	}
+	tmp := s.filename + ".tmp"
+	fh, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(fh)
+	var n int
+	write := func(r fileRecord) {
+		if err == nil {
+			err = enc.Encode(r)
+			n++
+		}
+	}
+	for _, sess := range snap.Sessions {
+		write(fileRecord{Op: opSession, ClientID: sess.ClientID, Expiry: sess.ExpiryInterval})
+		for _, sub := range sess.Subscriptions {
+			write(fileRecord{Op: opSubscription, ClientID: sess.ClientID, Sub: &sub})
+		}
+		for _, m := range sess.Messages {
+			write(fileRecord{
+				Op:       opMessage,
+				ClientID: sess.ClientID,
+				Sent:     m.Sent,
+				Released: m.Released,
+				Packet:   encode(m.Publish),
+				Expires:  expiresRecord(m.Expires),
+			})
+		}
+	}
+	for _, v := range snap.Retained {
+		write(fileRecord{
+			Op:      opRetained,
+			Packet:  encode(v.Publish),
+			Expires: expiresRecord(v.Expires),
+		})
+	}
+	if err == nil {
+		err = fh.Sync()
+	}
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.filename); err != nil {
+		return err
+	}
+
+	// continue appending to the compacted file
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.filename, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	s.enc = json.NewEncoder(s.file)
+	s.written = n
+	s.compactAt = max(2*n, s.minCompact)
+	return nil
+}
+
+var ErrBadRecord = fmt.Errorf("bad store record")
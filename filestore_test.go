@@ -0,0 +1,73 @@
+package tt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gregoryv/mq"
+)
+
+func TestFileStore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tt.store")
+	s, err := OpenFileStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+	s.Close()
+
+	// state survives reopen
+	s, err = OpenFileStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	snap, _ := s.Load()
+	if len(snap.Sessions) != 1 || len(snap.Retained) != 1 {
+		t.Errorf("state lost: %v sessions, %v retained",
+			len(snap.Sessions), len(snap.Retained),
+		)
+	}
+}
+
+func TestFileStore_compact(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tt.store")
+	s, _ := OpenFileStore(filename)
+	defer s.Close()
+	s.minCompact = 10
+
+	p := mq.Pub(0, "a/b", "hi")
+	for i := 0; i < 100; i++ {
+		s.SaveRetained(StoredRetained{Publish: p})
+	}
+	if s.written > s.compactAt {
+		t.Error("not compacted", s.written)
+	}
+	if _, err := os.Stat(filename + ".tmp"); err == nil {
+		t.Error("temporary file remains")
+	}
+}
+
+func TestFileStore_partialRecord(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tt.store")
+	os.WriteFile(filename, []byte(`{"op":"session","c":"a","e":10}
+{"op":"sess`), 0o600)
+	s, err := OpenFileStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	snap, _ := s.Load()
+	if len(snap.Sessions) != 1 {
+		t.Error("expected 1 session, got", len(snap.Sessions))
+	}
+}
+
+func TestFileStore_badRecord(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tt.store")
+	os.WriteFile(filename, []byte(`{"op":"what"}`), 0o600)
+	if _, err := OpenFileStore(filename); err == nil {
+		t.Error("expected error")
+	}
+}
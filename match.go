@@ -7,10 +7,13 @@ import (
 // https://docs.oasis-open.org/mqtt/mqtt/v5.0/os/mqtt-v5.0-os.html#_Toc3901241
 
 func match(filter, topicName string) bool {
+	// 4.7.2-1 topic names starting with $ are not matched by
+	// filters starting with a wildcard
+	if strings.HasPrefix(topicName, "$") &&
+		(strings.HasPrefix(filter, "#") || strings.HasPrefix(filter, "+")) {
+		return false
+	}
 	if filter == "#" {
-		if topicName[0] == '$' {
-			return false
-		}
 		return true
 	}
 
@@ -21,7 +24,7 @@ func match(filter, topicName string) bool {
 	case hasNumberSign && !hasPlusSign:
 		// a/b/#  a/b
 		prefix := filter[:len(filter)-2]
-		return strings.HasPrefix(topicName, prefix)
+		return topicName == prefix || strings.HasPrefix(topicName, prefix+"/")
 
 	case hasNumberSign && hasPlusSign:
 		// a/+/#  a/b/c
@@ -10,6 +10,9 @@ func Test_Match(t *testing.T) {
 	if err := spec.VerifyFilterMatching(match); err != nil {
 		t.Error(err)
 	}
+	if match("a/#", "ab") {
+		t.Error("a/# should NOT match ab")
+	}
 }
 
 func Benchmark_match(b *testing.B) {
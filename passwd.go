@@ -0,0 +1,187 @@
+package tt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gregoryv/mq"
+)
+
+// LoadPasswordFile returns an authenticator using the given
+// mosquitto style password file.
+func LoadPasswordFile(filename string) (*PasswordFile, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	var pf PasswordFile
+	if err := pf.Load(fh); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return &pf, nil
+}
+
+// PasswordFile authenticates clients by username and password using
+// hashes as written by mosquitto_passwd. Lines have the format
+//
+//	username:$6$salt$hash
+//	username:$7$iterations$salt$hash
+//
+// where $6$ is sha512(password + salt) and $7$ is PBKDF2 using
+// sha512. Salt and hash are base64 encoded.
+type PasswordFile struct {
+	m     sync.RWMutex
+	users map[string]*passwordHash
+}
+
+// Load replaces all users with those read from r. Empty lines and
+// lines starting with # are ignored.
+func (f *PasswordFile) Load(r io.Reader) error {
+	users := make(map[string]*passwordHash)
+	s := bufio.NewScanner(r)
+	var lineno int
+	for s.Scan() {
+		lineno++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		name, v, found := strings.Cut(line, ":")
+		if !found {
+			return fmt.Errorf("line %v: missing :", lineno)
+		}
+		h, err := parsePasswordHash(v)
+		if err != nil {
+			return fmt.Errorf("line %v: %w", lineno, err)
+		}
+		users[name] = h
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	f.m.Lock()
+	f.users = users
+	f.m.Unlock()
+	return nil
+}
+
+// Authenticate returns mq.NotAuthorized if no username is given and
+// mq.BadUserNameOrPassword if user is unknown or password does not
+// match.
+func (f *PasswordFile) Authenticate(_ context.Context, v *ConnectInfo) mq.ReasonCode {
+	if v.Username == "" {
+		return mq.NotAuthorized
+	}
+	f.m.RLock()
+	h, found := f.users[v.Username]
+	f.m.RUnlock()
+	if !found || !h.Match(v.Password) {
+		return mq.BadUserNameOrPassword
+	}
+	return mq.Success
+}
+
+// ----------------------------------------
+
+func parsePasswordHash(v string) (*passwordHash, error) {
+	parts := strings.Split(v, "$")
+	// first part is empty as v starts with $
+	if len(parts) < 4 || parts[0] != "" {
+		return nil, ErrPasswordHash
+	}
+	var h passwordHash
+	switch parts[1] {
+	case "6":
+		if len(parts) != 4 {
+			return nil, ErrPasswordHash
+		}
+		h.iterations = 0
+		parts = parts[2:]
+
+	case "7":
+		if len(parts) != 5 {
+			return nil, ErrPasswordHash
+		}
+		n, err := strconv.Atoi(parts[2])
+		if err != nil || n < 1 {
+			return nil, ErrPasswordHash
+		}
+		h.iterations = n
+		parts = parts[3:]
+
+	default:
+		return nil, fmt.Errorf("%w: unsupported type %q", ErrPasswordHash, parts[1])
+	}
+	var err error
+	if h.salt, err = base64.StdEncoding.DecodeString(parts[0]); err != nil {
+		return nil, ErrPasswordHash
+	}
+	if h.hash, err = base64.StdEncoding.DecodeString(parts[1]); err != nil {
+		return nil, ErrPasswordHash
+	}
+	return &h, nil
+}
+
+var ErrPasswordHash = fmt.Errorf("bad password hash")
+
+type passwordHash struct {
+	// 0 for plain sha512
+	iterations int
+	salt       []byte
+	hash       []byte
+}
+
+// Match returns true if password results in the same hash.
+func (h *passwordHash) Match(password []byte) bool {
+	var got []byte
+	if h.iterations == 0 {
+		sum := sha512.Sum512(append(bytes.Clone(password), h.salt...))
+		got = sum[:]
+	} else {
+		got = pbkdf2(sha512.New, password, h.salt, h.iterations, len(h.hash))
+	}
+	return subtle.ConstantTimeCompare(got, h.hash) == 1
+}
+
+// pbkdf2 derives a key as defined in RFC 8018 section 5.2.
+func pbkdf2(h func() hash.Hash, password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(h, password)
+	size := prf.Size()
+	blocks := (keyLen + size - 1) / size
+
+	var dk []byte
+	u := make([]byte, size)
+	t := make([]byte, size)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{
+			byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block),
+		})
+		u = prf.Sum(u[:0])
+		copy(t, u)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		dk = append(dk, t...)
+	}
+	return dk[:keyLen]
+}
@@ -0,0 +1,59 @@
+package tt
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gregoryv/mq"
+)
+
+func TestPasswordFile(t *testing.T) {
+	// hashes of "secret" using salt 0123456789ab
+	data := `# comment
+plain:$6$MDEyMzQ1Njc4OWFi$qEXipeLbgxRlwd06QHfY5WITkUZg0jLg9SZbXzq3ifXjfj+v3GbJGrSfC5PAg3UNCS+UFfbhUIZX4bmIAs330w==
+pbkdf2:$7$101$MDEyMzQ1Njc4OWFi$EO/lLlkeUgIiBaS8G8UK0ZMP1u508TA7Tl+AdJ1cEsmlbGyEPAERErpfq84j1kepISs0UzmcdL4ucgZ2uodxfQ==
+`
+	filename := filepath.Join(t.TempDir(), "passwd")
+	os.WriteFile(filename, []byte(data), 0o600)
+	pf, err := LoadPasswordFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	check := func(username, password string, exp mq.ReasonCode) {
+		t.Helper()
+		v := &ConnectInfo{Username: username, Password: []byte(password)}
+		if got := pf.Authenticate(ctx, v); got != exp {
+			t.Errorf("%s:%s got %v, expected %v", username, password, got, exp)
+		}
+	}
+	check("plain", "secret", mq.Success)
+	check("pbkdf2", "secret", mq.Success)
+	check("plain", "wrong", mq.BadUserNameOrPassword)
+	check("pbkdf2", "wrong", mq.BadUserNameOrPassword)
+	check("nobody", "secret", mq.BadUserNameOrPassword)
+	check("", "", mq.NotAuthorized)
+}
+
+func TestPasswordFile_Load(t *testing.T) {
+	bad := []string{
+		"nocolon",
+		"a:plaintext",
+		"a:$5$abc$def",
+		"a:$7$x$MDEy$MDEy",
+		"a:$6$%%%$MDEy",
+	}
+	for _, line := range bad {
+		var pf PasswordFile
+		if err := pf.Load(strings.NewReader(line)); err == nil {
+			t.Errorf("%q loaded", line)
+		}
+	}
+	if _, err := LoadPasswordFile("no/such/file"); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,183 @@
+package tt
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gregoryv/mq"
+)
+
+// Overflow decides what happens when a QoS 0 publish packet is added
+// to a full outbound queue of a client. QoS 1 and 2 packets are
+// never dropped, they are limited by the Receive Maximum of the
+// client and kept in the session.
+type Overflow uint8
+
+const (
+	OverflowDropNewest Overflow = iota // the added message
+	OverflowDropOldest                 // the first queued message
+	OverflowDisconnect                 // close the client connection
+)
+
+func (v Overflow) String() string {
+	switch v {
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowDisconnect:
+		return "disconnect"
+	}
+	return fmt.Sprintf("Overflow(%d)", uint8(v))
+}
+
+// ----------------------------------------
+
+func newOutQueue(max int, overflow Overflow) *outQueue {
+	return &outQueue{
+		max:      max,
+		overflow: overflow,
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+// outQueue holds packets to be written to a client in order. Only
+// QoS 0 publish packets are limited and dropped on overflow. Safe for
+// concurrent use.
+type outQueue struct {
+	m         sync.Mutex
+	packets   []queued
+	publishes int
+	closed    bool
+
+	max      int
+	overflow Overflow
+
+	// signals the writer that packets are queued
+	ready chan struct{}
+}
+
+type queued struct {
+	mq.Packet
+
+	// receives the write result, nil for publish packets
+	done chan error
+
+	// zero if the packet never expires
+	expires time.Time
+}
+
+// Put adds p to the queue. Returns dropped publish packets and false
+// if the overflow policy is to disconnect.
+func (q *outQueue) Put(p mq.Packet, done chan error) (dropped []*mq.Publish, ok bool) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if q.closed {
+		if done != nil {
+			done <- ErrQueueClosed
+		}
+		return nil, true
+	}
+	if p, ok := droppable(p); ok {
+		if q.max > 0 && q.publishes >= q.max {
+			switch q.overflow {
+			case OverflowDropNewest:
+				return []*mq.Publish{p}, true
+			case OverflowDropOldest:
+				dropped = append(dropped, q.removeFirstPublish())
+			default:
+				return []*mq.Publish{p}, false
+			}
+		}
+		q.publishes++
+	}
+	v := queued{Packet: p, done: done}
+	if p, ok := p.(*mq.Publish); ok {
+		v.expires = expiresAt(p)
+	}
+	q.packets = append(q.packets, v)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return dropped, true
+}
+
+// removeFirstPublish, caller must hold the lock.
+func (q *outQueue) removeFirstPublish() *mq.Publish {
+	for i, v := range q.packets {
+		if p, ok := droppable(v.Packet); ok {
+			q.packets = append(q.packets[:i], q.packets[i+1:]...)
+			q.publishes--
+			return p
+		}
+	}
+	return nil
+}
+
+// Next blocks until a packet is queued. Returns false if the queue is
+// closed or the context done.
+func (q *outQueue) Next(ctx context.Context) (queued, bool) {
+	for {
+		q.m.Lock()
+		if q.closed {
+			q.m.Unlock()
+			return queued{}, false
+		}
+		if len(q.packets) > 0 {
+			v := q.packets[0]
+			q.packets[0] = queued{}
+			q.packets = q.packets[1:]
+			if _, ok := droppable(v.Packet); ok {
+				q.publishes--
+			}
+			q.m.Unlock()
+			return v, true
+		}
+		q.m.Unlock()
+
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return queued{}, false
+		}
+	}
+}
+
+// Close releases the writer and fails packets waiting to be
+// written.
+func (q *outQueue) Close() {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	for _, v := range q.packets {
+		if v.done != nil {
+			v.done <- ErrQueueClosed
+		}
+	}
+	q.packets = nil
+	q.publishes = 0
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Len returns number of queued QoS 0 publish packets.
+func (q *outQueue) Len() int {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return q.publishes
+}
+
+func droppable(p mq.Packet) (*mq.Publish, bool) {
+	v, ok := p.(*mq.Publish)
+	return v, ok && v.QoS() == 0
+}
+
+var ErrQueueClosed = fmt.Errorf("queue closed")
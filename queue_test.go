@@ -0,0 +1,170 @@
+package tt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gregoryv/mq"
+	"github.com/gregoryv/tt/event"
+)
+
+func Test_outQueue(t *testing.T) {
+	put := func(q *outQueue, n int) (dropped []string, ok bool) {
+		for i := 0; i < n; i++ {
+			d, ok := q.Put(mq.Pub(0, fmt.Sprint(i), ""), nil)
+			if !ok {
+				return dropped, false
+			}
+			for _, p := range d {
+				dropped = append(dropped, p.TopicName())
+			}
+		}
+		return dropped, true
+	}
+	ctx := context.Background()
+
+	q := newOutQueue(2, OverflowDropNewest)
+	if v, _ := put(q, 3); len(v) != 1 || v[0] != "2" {
+		t.Error("drop newest", v)
+	}
+	// control packets are never dropped
+	q.Put(mq.NewPingResp(), nil)
+	if v, _ := q.Next(ctx); v.Packet.(*mq.Publish).TopicName() != "0" {
+		t.Error("unexpected", v)
+	}
+
+	q = newOutQueue(2, OverflowDropOldest)
+	if v, _ := put(q, 3); len(v) != 1 || v[0] != "0" {
+		t.Error("drop oldest", v)
+	}
+	if v := q.Len(); v != 2 {
+		t.Error("Len", v)
+	}
+
+	q = newOutQueue(2, OverflowDisconnect)
+	if _, ok := put(q, 3); ok {
+		t.Error("expected disconnect")
+	}
+
+	q.Close()
+	done := make(chan error, 1)
+	q.Put(mq.NewPingResp(), done)
+	if err := <-done; err != ErrQueueClosed {
+		t.Error(err)
+	}
+	if _, ok := q.Next(ctx); ok {
+		t.Error("Next on closed queue")
+	}
+}
+
+// A subscriber not reading does not block the publisher.
+func TestServer_SlowSubscriber(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	s.SetMaxQueued(2)
+	s.SetOverflow(OverflowDropOldest)
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	connect := func(id string) net.Conn {
+		conn := pipeConn(ctx, s)
+		t.Cleanup(func() { conn.Close() })
+		p := mq.NewConnect()
+		p.SetClientID(id)
+		p.WriteTo(conn)
+		_, _ = mq.ReadPacket(conn)
+		return conn
+	}
+	sub := connect("sub")
+	p := mq.NewSubscribe()
+	p.SetPacketID(1)
+	p.AddFilters(mq.NewTopicFilter("a/#", 0))
+	p.WriteTo(sub)
+	_, _ = mq.ReadPacket(sub)
+
+	pub := connect("pub")
+	sc, _ := s.clients.Get("sub")
+	for i := 0; i < 5; i++ {
+		pub.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := mq.Pub(0, "a/b", fmt.Sprint(i)).WriteTo(pub); err != nil {
+			t.Fatal("publisher blocked", err)
+		}
+		if i > 0 {
+			continue
+		}
+		// wait for the writer to block on the first message, the
+		// PingResp ensures it's routed
+		mq.NewPingReq().WriteTo(pub)
+		_, _ = mq.ReadPacket(pub)
+		for sc.out.Len() > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	mq.NewPingReq().WriteTo(pub)
+	_, _ = mq.ReadPacket(pub)
+
+	select {
+	case v := <-s.Events():
+		if _, ok := v.(event.ServerDropMessage); !ok {
+			t.Error("unexpected event", v)
+		}
+	case <-time.After(time.Second):
+		t.Error("missing drop event")
+	}
+
+	// the first message is being written, 1 and 2 are dropped
+	var got []string
+	for i := 0; i < 3; i++ {
+		p, _ := mq.ReadPacket(sub)
+		if p, ok := p.(*mq.Publish); ok {
+			got = append(got, string(p.Payload()))
+		}
+	}
+	if fmt.Sprint(got) != "[0 3 4]" {
+		t.Error("unexpected", got)
+	}
+}
+
+func TestServer_SlowSubscriberDisconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	s.SetMaxQueued(1)
+	s.SetOverflow(OverflowDisconnect)
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	sub := pipeConn(ctx, s)
+	t.Cleanup(func() { sub.Close() })
+	mq.NewConnect().WriteTo(sub)
+	_, _ = mq.ReadPacket(sub)
+	p := mq.NewSubscribe()
+	p.SetPacketID(1)
+	p.AddFilters(mq.NewTopicFilter("a/#", 0))
+	p.WriteTo(sub)
+	_, _ = mq.ReadPacket(sub)
+
+	pub := pipeConn(ctx, s)
+	t.Cleanup(func() { pub.Close() })
+	mq.NewConnect().WriteTo(pub)
+	_, _ = mq.ReadPacket(pub)
+	for i := 0; i < 3; i++ {
+		mq.Pub(0, "a/b", "hi").WriteTo(pub)
+	}
+
+	sub.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, err := mq.ReadPacket(sub); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Error("slow subscriber still connected")
+			}
+			return
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package tt
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"time"
@@ -24,6 +26,10 @@ type receiver struct {
 	wire     io.Reader
 	handle   handlerFunc
 	deadline time.Duration
+
+	// packets larger than maxSize bytes fail with
+	// ErrPacketTooLarge, 0 means no limit
+	maxSize uint32
 }
 
 // Run handles packets until context is cancelled.
@@ -35,7 +41,7 @@ func (r *receiver) Run(ctx context.Context) error {
 		if w, ok := r.wire.(hasReadDeadline); ok {
 			_ = w.SetReadDeadline(time.Now().Add(r.deadline))
 		}
-		p, err := mq.ReadPacket(r.wire)
+		p, err := r.read(ctx)
 		if err != nil {
 			if errors.Is(err, os.ErrDeadlineExceeded) {
 				continue
@@ -46,6 +52,90 @@ func (r *receiver) Run(ctx context.Context) error {
 	}
 }
 
+// read returns the next packet. Once the first byte is read, read
+// deadlines are ignored until the packet is complete.
+func (r *receiver) read(ctx context.Context) (mq.Packet, error) {
+	if r.maxSize == 0 {
+		return mq.ReadPacket(r.wire)
+	}
+	// fixed header byte and remaining length, see 2.1.1
+	header := make([]byte, 1, 5)
+	if _, err := io.ReadFull(r.wire, header); err != nil {
+		return nil, err
+	}
+	var remaining, multiplier int = 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, ErrMalformedLength
+		}
+		b := make([]byte, 1)
+		if err := r.readFull(ctx, b); err != nil {
+			return nil, err
+		}
+		header = append(header, b[0])
+		remaining += int(b[0]&127) * multiplier
+		if b[0]&128 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	size := len(header) + remaining
+	if size > int(r.maxSize) {
+		return nil, fmt.Errorf("%w: %v bytes", ErrPacketTooLarge, size)
+	}
+	buf := make([]byte, size)
+	copy(buf, header)
+	if err := r.readFull(ctx, buf[len(header):]); err != nil {
+		return nil, err
+	}
+	return mq.ReadPacket(bytes.NewReader(buf))
+}
+
+// readFull reads len(p) bytes retrying on read deadlines.
+func (r *receiver) readFull(ctx context.Context, p []byte) error {
+	for len(p) > 0 {
+		n, err := r.wire.Read(p)
+		p = p[n:]
+		switch {
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if w, ok := r.wire.(hasReadDeadline); ok {
+				_ = w.SetReadDeadline(time.Now().Add(r.deadline))
+			}
+		case err != nil && len(p) > 0:
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	ErrPacketTooLarge  = fmt.Errorf("packet too large")
+	ErrMalformedLength = fmt.Errorf("malformed remaining length")
+)
+
 type hasReadDeadline interface {
 	SetReadDeadline(time.Time) error
 }
+
+// countingReader reports number of bytes read, keeping the read
+// deadline of the underlying reader.
+type countingReader struct {
+	io.Reader
+	add func(int64)
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.add(int64(n))
+	return n, err
+}
+
+func (r *countingReader) SetReadDeadline(t time.Time) error {
+	if w, ok := r.Reader.(hasReadDeadline); ok {
+		return w.SetReadDeadline(t)
+	}
+	return nil
+}
@@ -48,6 +48,22 @@ func Test_receiver(t *testing.T) {
 		}
 	}
 
+	{ // packets larger than max size fail
+		conn, srvconn := net.Pipe()
+		defer conn.Close()
+		called := ttx.NewCalled()
+		recv := newReceiver(called.Handler, srvconn)
+		recv.maxSize = 20
+		go func() {
+			mq.Pub(0, "a/b", "hi").WriteTo(conn)
+			mq.Pub(0, "a/b", "too large to fit").WriteTo(conn)
+		}()
+		if err := recv.Run(context.Background()); !errors.Is(err, ErrPacketTooLarge) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		<-called.Done()
+	}
+
 	{ // Run is stopped on closed connection
 		recv := newReceiver(nil, &ttx.ClosedConn{})
 		if err := recv.Run(context.Background()); err == nil {
@@ -0,0 +1,81 @@
+package tt
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gregoryv/mq"
+)
+
+func newRetained() *retained {
+	return &retained{
+		topics: make(map[string]retainedMsg),
+	}
+}
+
+// retained keeps the last retained publish packet for each topic
+// name. Safe for concurrent use.
+type retained struct {
+	m      sync.RWMutex
+	topics map[string]retainedMsg
+}
+
+type retainedMsg struct {
+	*mq.Publish
+
+	// zero if the message never expires
+	expires time.Time
+}
+
+// Store keeps a copy of p as the retained message of its topic. A
+// zero length payload removes the retained message. Messages with a
+// Message Expiry Interval are removed once expired.
+//
+// See 3.3.1.3 RETAIN
+func (r *retained) Store(p *mq.Publish) {
+	r.StoreUntil(p, expiresAt(p))
+}
+
+// StoreUntil is like Store with the given expiry time, zero if p
+// never expires.
+func (r *retained) StoreUntil(p *mq.Publish, expires time.Time) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	name := p.TopicName()
+	if len(p.Payload()) == 0 || expired(expires) {
+		delete(r.topics, name)
+		return
+	}
+	r.topics[name] = retainedMsg{
+		Publish: copyPublish(p),
+		expires: expires,
+	}
+}
+
+// Match returns retained messages with topic names matching the
+// given filter, with the remaining Message Expiry Interval.
+func (r *retained) Match(filter string) []*mq.Publish {
+	// write lock as expired messages are removed
+	r.m.Lock()
+	defer r.m.Unlock()
+	var res []*mq.Publish
+	for name, v := range r.topics {
+		if !match(filter, name) {
+			continue
+		}
+		p, ok := remaining(v.Publish, v.expires)
+		if !ok {
+			delete(r.topics, name)
+			continue
+		}
+		res = append(res, p)
+	}
+	return res
+}
+
+// Len returns number of retained messages.
+func (r *retained) Len() int {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return len(r.topics)
+}
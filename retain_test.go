@@ -0,0 +1,28 @@
+package tt
+
+import (
+	"testing"
+
+	"github.com/gregoryv/mq"
+)
+
+func Test_retained(t *testing.T) {
+	r := newRetained()
+	p := mq.Pub(0, "a/b", "hello")
+	p.SetRetain(true)
+	r.Store(p)
+	r.Store(mq.Pub(1, "a/c", "gopher"))
+
+	if got := r.Match("a/+"); len(got) != 2 {
+		t.Error("expected 2 retained, got", len(got))
+	}
+	if got := r.Match("b/#"); len(got) != 0 {
+		t.Error("expected no match, got", got)
+	}
+
+	// empty payload removes
+	r.Store(mq.Pub(0, "a/b", ""))
+	if v := r.Len(); v != 1 {
+		t.Error("expected 1 retained, got", v)
+	}
+}
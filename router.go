@@ -7,68 +7,315 @@ import (
 	"sync"
 
 	"github.com/gregoryv/mq"
+	"github.com/gregoryv/tt/arn"
 )
 
 // newRouter returns a router for handling the given subscriptions.
 func newRouter() *router {
 	return &router{
-		log:     log.New(log.Writer(), "router ", log.Flags()),
-		filtSub: make(map[string][]*subscription),
+		log:      log.New(log.Writer(), "router ", log.Flags()),
+		tree:     arn.NewTree(),
+		shared:   make(map[string]*shareGroup),
+		byClient: make(map[string]map[string]struct{}),
+		share:    NewRoundRobinShare(),
 	}
 }
 
 type router struct {
 	log *log.Logger
 
-	// topic filter -> subscription
-	m       sync.RWMutex
-	filtSub map[string][]*subscription
+	// topic filter -> *route
+	m    sync.RWMutex
+	tree *arn.Tree
+
+	// $share/{ShareName}/{filter} -> group
+	shared map[string]*shareGroup
+	share  ShareStrategy
+
+	// client ID -> subscribed filters, including shared
+	byClient map[string]map[string]struct{}
+}
+
+// route is the value of each filter in the tree.
+type route struct {
+	filter        string
+	subscriptions []*subscription
+
+	// shared subscriptions of the filter by
+	// $share/{ShareName}/{filter}
+	groups map[string]*shareGroup
 }
 
 func (r *router) String() string {
-	var c int
-	for _, s := range r.filtSub {
-		c += len(s)
-	}
+	c := r.Len()
 	if c == 1 {
 		return "1 subscription"
 	}
 	return fmt.Sprintf("%v subscriptions", c)
 }
 
+// Len returns number of subscribed filters, including shared.
+func (r *router) Len() int {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	var c int
+	for _, n := range r.tree.Leafs() {
+		c += len(n.Value.(*route).subscriptions)
+	}
+	for _, g := range r.shared {
+		c += len(g.members)
+	}
+	return c
+}
+
+// AddSubscriptions adds the subscriptions to the router. Subscriptions
+// of a client replace any existing one with an identical filter for
+// that client, 3.8.4 SUBSCRIBE Actions.
 func (r *router) AddSubscriptions(v ...*subscription) {
 	r.m.Lock()
 	defer r.m.Unlock()
 	for _, s := range v {
 		for _, f := range s.filters {
-			r.filtSub[f] = append(r.filtSub[f], s)
+			if s.clientID != "" {
+				r.remove(s.clientID, f)
+				filters, found := r.byClient[s.clientID]
+				if !found {
+					filters = make(map[string]struct{})
+					r.byClient[s.clientID] = filters
+				}
+				filters[f] = struct{}{}
+			}
+			if _, filter, ok := parseShared(f); ok {
+				g, found := r.shared[f]
+				if !found {
+					g = &shareGroup{filter: filter}
+					r.shared[f] = g
+					r.routeOf(filter).groups[f] = g
+				}
+				g.members = append(g.members, s)
+				continue
+			}
+			rt := r.routeOf(f)
+			rt.subscriptions = append(rt.subscriptions, s)
 		}
 	}
 }
 
-func (r *router) removeFilters(sc *sclient, filters []string) {
+// routeOf returns the route of filter f, adding it if missing, caller
+// must hold the lock.
+func (r *router) routeOf(f string) *route {
+	n := r.tree.AddFilter(f)
+	if n.Value == nil {
+		n.Value = &route{
+			filter: f,
+			groups: make(map[string]*shareGroup),
+		}
+	}
+	return n.Value.(*route)
+}
+
+// cleanup removes the route of filter f if unused, caller must hold
+// the lock.
+func (r *router) cleanup(rt *route) {
+	if len(rt.subscriptions) == 0 && len(rt.groups) == 0 {
+		r.tree.RemoveFilter(rt.filter)
+	}
+}
+
+// Subscribed returns true if the client has a subscription with the
+// given filter.
+func (r *router) Subscribed(clientID, filter string) bool {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	var subscriptions []*subscription
+	if n, found := r.tree.Find(filter); found {
+		subscriptions = n.Value.(*route).subscriptions
+	}
+	if g, found := r.shared[filter]; found {
+		subscriptions = g.members
+	}
+	for _, s := range subscriptions {
+		if s.clientID == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// removeFilters removes the filters from subscriptions owned by the
+// given client. Returns true for each filter that was subscribed to.
+func (r *router) removeFilters(clientID string, filters []string) []bool {
 	r.m.Lock()
 	defer r.m.Unlock()
+	existed := make([]bool, len(filters))
+	for i, f := range filters {
+		existed[i] = r.remove(clientID, f)
+	}
+	return existed
+}
 
-	// todo remove filters in router
+// removeClient removes all subscriptions owned by the given client.
+func (r *router) removeClient(clientID string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	for f := range r.byClient[clientID] {
+		r.remove(clientID, f)
+	}
+}
+
+// remove filter f from subscriptions of the client, caller must hold
+// the lock.
+func (r *router) remove(clientID, f string) (found bool) {
+	if filters, ok := r.byClient[clientID]; ok {
+		delete(filters, f)
+		if len(filters) == 0 {
+			delete(r.byClient, clientID)
+		}
+	}
+	var (
+		rt            *route
+		subscriptions []*subscription
+	)
+	g, shared := r.shared[f]
+	switch {
+	case shared:
+		subscriptions = g.members
+	default:
+		n, ok := r.tree.Find(f)
+		if !ok {
+			return false
+		}
+		rt = n.Value.(*route)
+		subscriptions = rt.subscriptions
+	}
+	keep := subscriptions[:0]
+	for _, s := range subscriptions {
+		if s.clientID == clientID {
+			s.removeTopicFilter(f)
+			found = true
+			continue
+		}
+		keep = append(keep, s)
+	}
+	switch {
+	case shared && len(keep) == 0:
+		delete(r.shared, f)
+		if n, ok := r.tree.Find(g.filter); ok {
+			rt := n.Value.(*route)
+			delete(rt.groups, f)
+			r.cleanup(rt)
+		}
+	case shared:
+		g.members = keep
+	default:
+		rt.subscriptions = keep
+		r.cleanup(rt)
+	}
+	return
 }
 
 // Route routes mq.Publish packets by topic name.
 func (r *router) Route(ctx context.Context, p mq.Packet) error {
+	return r.RouteFrom(ctx, "", p)
+}
+
+// RouteFrom routes mq.Publish packets published by the given client
+// by topic name. Use empty clientID for messages originating from the
+// server.
+func (r *router) RouteFrom(ctx context.Context, clientID string, p mq.Packet) error {
 	r.m.RLock()
 	defer r.m.RUnlock()
 	switch p := p.(type) {
 	case *mq.Publish:
-		for filter, subscriptions := range r.filtSub {
-			if match(filter, p.TopicName()) {
-				for _, s := range subscriptions {
-					for _, h := range s.handlers {
-						h(ctx, p)
-					}
+		// 3.3.4 overlapping subscriptions of one client result in
+		// one message
+		var deliveries []*delivery
+		byClient := make(map[string]*delivery)
+		var nodes []*arn.Node
+		r.tree.Match(&nodes, p.TopicName())
+		for _, n := range nodes {
+			rt := n.Value.(*route)
+			for _, s := range rt.subscriptions {
+				qos, retain, ok := s.deliveryOf(rt.filter, clientID, p)
+				if !ok {
+					continue
 				}
+				d, found := byClient[s.clientID]
+				if !found || s.clientID == "" {
+					d = &delivery{sub: s}
+					deliveries = append(deliveries, d)
+					byClient[s.clientID] = d
+				}
+				d.add(s, qos, retain)
+			}
+			// 4.8.2 each shared subscription delivers to one member
+			for share, g := range rt.groups {
+				s := g.members[r.pick(share, p, g.members)]
+				qos, retain, _ := s.deliveryOf(share, clientID, p)
+				d := &delivery{sub: s}
+				d.add(s, qos, retain)
+				deliveries = append(deliveries, d)
 			}
 		}
+		for _, d := range deliveries {
+			d.handle(ctx, p)
+		}
 
 	}
 	return ctx.Err()
 }
+
+// pick returns index of the member to receive p, caller must hold
+// the lock.
+func (r *router) pick(share string, p *mq.Publish, members []*subscription) int {
+	if len(members) == 1 {
+		return 0
+	}
+	v := make([]ShareMember, len(members))
+	for i, s := range members {
+		v[i].ClientID = s.clientID
+		if s.inflight != nil {
+			v[i].Inflight = s.inflight()
+		}
+	}
+	i := r.share.Pick(share, p, v)
+	if i < 0 || i >= len(members) {
+		return 0
+	}
+	return i
+}
+
+// delivery of one message to a client, collected from all matching
+// subscriptions.
+type delivery struct {
+	sub    *subscription
+	qos    uint8
+	retain bool
+	ids    []uint32
+}
+
+// add includes a matching subscription, the message is delivered
+// with the maximum QoS of all matching subscriptions.
+func (d *delivery) add(s *subscription, qos uint8, retain bool) {
+	d.qos = max(d.qos, qos)
+	d.retain = d.retain || retain
+	if s.subscriptionID > 0 {
+		d.ids = append(d.ids, uint32(s.subscriptionID))
+	}
+}
+
+// handle calls the subscription handlers with p adapted to the
+// delivery.
+func (d *delivery) handle(ctx context.Context, p *mq.Publish) {
+	if d.qos != p.QoS() || d.retain != p.Retain() || len(d.ids) > 0 {
+		p = copyPublish(p)
+		p.SetQoS(d.qos)
+		p.SetRetain(d.retain)
+		for _, id := range d.ids {
+			p.AddSubscriptionID(id)
+		}
+	}
+	for _, h := range d.sub.handlers {
+		h(ctx, p)
+	}
+}
@@ -37,6 +37,62 @@ func Test_router(t *testing.T) {
 	}
 }
 
+func Test_router_removeFilters(t *testing.T) {
+	r := newRouter()
+	a := mustNewSubscription("a/b", ttx.NoopPub)
+	a.clientID = "a"
+	a.addTopicFilter("a/c")
+	b := mustNewSubscription("a/b", ttx.NoopPub)
+	b.clientID = "b"
+	r.AddSubscriptions(a, b)
+
+	existed := r.removeFilters("a", []string{"a/b", "x"})
+	if !existed[0] || existed[1] {
+		t.Error("unexpected", existed)
+	}
+	if r.Subscribed("a", "a/b") || !r.Subscribed("b", "a/b") {
+		t.Error("removed wrong subscription", r)
+	}
+
+	r.removeClient("a")
+	if v := r.String(); v != "1 subscription" {
+		t.Error(v)
+	}
+}
+
+// Subscribing to the same filter again replaces the subscription.
+func Test_router_replace(t *testing.T) {
+	r := newRouter()
+	for i := 0; i < 2; i++ {
+		s := mustNewSubscription("a/b", ttx.NoopPub)
+		s.clientID = "a"
+		r.AddSubscriptions(s)
+	}
+	if v := r.String(); v != "1 subscription" {
+		t.Error(v)
+	}
+}
+
+// Overlapping subscriptions of one client result in one message.
+func Test_router_overlapping(t *testing.T) {
+	r := newRouter()
+	var got []*mq.Publish
+	handle := func(_ context.Context, p *mq.Publish) error {
+		got = append(got, p)
+		return nil
+	}
+	for i, filter := range []string{"a/#", "a/+", "b"} {
+		s := mustNewSubscription(filter, handle)
+		s.clientID = "a"
+		s.subscriptionID = i + 1
+		r.AddSubscriptions(s)
+	}
+	_ = r.Route(context.Background(), mq.Pub(0, "a/b", "hi"))
+	if len(got) != 1 || len(got[0].SubscriptionIDs()) != 2 {
+		t.Error("unexpected", got)
+	}
+}
+
 func BenchmarkRouter_All(b *testing.B) {
 	r := newRouter()
 	for i := 0; i < 10; i++ {
@@ -89,3 +145,63 @@ func BenchmarkRouter_End(b *testing.B) {
 		}
 	}
 }
+
+// Routing time should grow sub-linear with number of subscriptions.
+func BenchmarkRouter_Size(b *testing.B) {
+	shapes := []struct {
+		name   string
+		filter func(i int) string
+		topic  string
+	}{
+		{"nested", func(i int) string {
+			if i%100 == 0 {
+				return fmt.Sprintf("site/%v/+/#", i/100)
+			}
+			return fmt.Sprintf("site/%v/sensor/%v", i/100, i%100)
+		}, "site/7/sensor/42"},
+		{"flat", func(i int) string {
+			return fmt.Sprintf("dev/%v", i)
+		}, "dev/742"},
+	}
+	for _, shape := range shapes {
+		for _, size := range []int{1_000, 10_000, 100_000} {
+			b.Run(fmt.Sprint(shape.name, "/", size), func(b *testing.B) {
+				r := newRouter()
+				for i := 0; i < size; i++ {
+					s := mustNewSubscription(shape.filter(i), ttx.NoopPub)
+					s.clientID = fmt.Sprint(i)
+					r.AddSubscriptions(s)
+				}
+				ctx := context.Background()
+				p := mq.Pub(0, shape.topic, "hi")
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := r.Route(ctx, p); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// Removing a client should not depend on number of subscriptions.
+func BenchmarkRouter_removeClient(b *testing.B) {
+	for _, size := range []int{1_000, 10_000, 100_000} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			r := newRouter()
+			for i := 0; i < size; i++ {
+				s := mustNewSubscription(fmt.Sprintf("dev/%v", i), ttx.NoopPub)
+				s.clientID = fmt.Sprint(i)
+				r.AddSubscriptions(s)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s := mustNewSubscription("dev/x", ttx.NoopPub)
+				s.clientID = "x"
+				r.AddSubscriptions(s)
+				r.removeClient("x")
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package tt
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gregoryv/mq"
+)
+
+// NewScramSHA256 returns the server side SCRAM-SHA-256 enhanced
+// authentication method, RFC 7677. Lookup returns the credentials of
+// a user, or false if unknown.
+func NewScramSHA256(lookup func(username string) (*ScramCredentials, bool)) *ScramSHA256 {
+	return &ScramSHA256{lookup: lookup}
+}
+
+type ScramSHA256 struct {
+	lookup func(username string) (*ScramCredentials, bool)
+}
+
+func (m *ScramSHA256) Name() string { return scramSHA256 }
+
+// Start returns a new exchange, which sets the username of v once
+// the client is authenticated.
+func (m *ScramSHA256) Start(_ context.Context, v *ConnectInfo) AuthExchange {
+	return &scramServer{lookup: m.lookup, info: v}
+}
+
+const scramSHA256 = "SCRAM-SHA-256"
+
+// NewScramCredentials returns credentials for the given password,
+// the password itself is not kept.
+func NewScramCredentials(password string, salt []byte, iterations int) *ScramCredentials {
+	salted := pbkdf2(sha256.New, []byte(password), salt, iterations, sha256.Size)
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return &ScramCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  hmacSHA256(salted, "Server Key"),
+	}
+}
+
+// ScramCredentials are stored by the server for each user, RFC 5802.
+type ScramCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// scramServer is one server side SCRAM exchange.
+type scramServer struct {
+	lookup func(string) (*ScramCredentials, bool)
+	info   *ConnectInfo
+
+	step        int
+	username    string
+	cred        *ScramCredentials
+	nonce       string
+	authMessage string
+}
+
+func (s *scramServer) Next(_ context.Context, data []byte) ([]byte, mq.ReasonCode) {
+	s.step++
+	switch s.step {
+	case 1: // client-first-message
+		msg := string(data)
+		// no channel binding support
+		if !strings.HasPrefix(msg, "n,,") && !strings.HasPrefix(msg, "y,,") {
+			return nil, mq.NotAuthorized
+		}
+		bare := msg[3:]
+		attr := scramAttributes(bare)
+		username, err := scramUnescape(attr["n"])
+		if err != nil || username == "" || attr["r"] == "" {
+			return nil, mq.NotAuthorized
+		}
+		cred, found := s.lookup(username)
+		if !found {
+			return nil, mq.NotAuthorized
+		}
+		s.username = username
+		s.cred = cred
+		s.nonce = attr["r"] + scramNonce()
+		first := fmt.Sprintf("r=%s,s=%s,i=%d",
+			s.nonce, base64.StdEncoding.EncodeToString(cred.Salt), cred.Iterations,
+		)
+		s.authMessage = bare + "," + first + ","
+		return []byte(first), mq.ContinueAuth
+
+	case 2: // client-final-message
+		msg := string(data)
+		i := strings.LastIndex(msg, ",p=")
+		if i < 0 {
+			return nil, mq.NotAuthorized
+		}
+		withoutProof := msg[:i]
+		attr := scramAttributes(withoutProof)
+		if attr["r"] != s.nonce || attr["c"] != "biws" && attr["c"] != "eSws" {
+			return nil, mq.NotAuthorized
+		}
+		proof, err := base64.StdEncoding.DecodeString(msg[i+3:])
+		if err != nil || len(proof) != sha256.Size {
+			return nil, mq.NotAuthorized
+		}
+		authMessage := s.authMessage + withoutProof
+		signature := hmacSHA256(s.cred.StoredKey, authMessage)
+		clientKey := make([]byte, sha256.Size)
+		for i := range clientKey {
+			clientKey[i] = proof[i] ^ signature[i]
+		}
+		storedKey := sha256.Sum256(clientKey)
+		if subtle.ConstantTimeCompare(storedKey[:], s.cred.StoredKey) != 1 {
+			return nil, mq.NotAuthorized
+		}
+		s.info.Username = s.username
+		v := hmacSHA256(s.cred.ServerKey, authMessage)
+		return []byte("v=" + base64.StdEncoding.EncodeToString(v)), mq.Success
+	}
+	return nil, mq.ProtocolError
+}
+
+// ----------------------------------------
+
+// NewScramClient returns the client side of SCRAM-SHA-256 enhanced
+// authentication, see [Client.SetAuthMethod].
+func NewScramClient(username, password string) *ScramClient {
+	return &ScramClient{
+		username: username,
+		password: password,
+	}
+}
+
+type ScramClient struct {
+	username string
+	password string
+
+	step      int
+	nonce     string
+	bare      string
+	serverSig []byte
+}
+
+func (c *ScramClient) Name() string { return scramSHA256 }
+
+// Start returns the client-first-message.
+func (c *ScramClient) Start() ([]byte, error) {
+	c.step = 0
+	c.nonce = scramNonce()
+	c.bare = "n=" + scramEscape(c.username) + ",r=" + c.nonce
+	return []byte("n,," + c.bare), nil
+}
+
+// Next returns the client-final-message in response to the
+// server-first-message and verifies the server-final-message.
+func (c *ScramClient) Next(data []byte) ([]byte, error) {
+	c.step++
+	msg := string(data)
+	attr := scramAttributes(msg)
+	if v, found := attr["e"]; found {
+		return nil, fmt.Errorf("%w: %s", ErrScram, v)
+	}
+	switch c.step {
+	case 1: // server-first-message
+		nonce := attr["r"]
+		if !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+			return nil, fmt.Errorf("%w: bad nonce", ErrScram)
+		}
+		salt, err := base64.StdEncoding.DecodeString(attr["s"])
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad salt", ErrScram)
+		}
+		iterations, err := strconv.Atoi(attr["i"])
+		if err != nil || iterations < 1 {
+			return nil, fmt.Errorf("%w: bad iteration count", ErrScram)
+		}
+		salted := pbkdf2(sha256.New, []byte(c.password), salt, iterations, sha256.Size)
+		clientKey := hmacSHA256(salted, "Client Key")
+		storedKey := sha256.Sum256(clientKey)
+
+		withoutProof := "c=biws,r=" + nonce
+		authMessage := c.bare + "," + msg + "," + withoutProof
+		signature := hmacSHA256(storedKey[:], authMessage)
+		proof := make([]byte, len(clientKey))
+		for i := range proof {
+			proof[i] = clientKey[i] ^ signature[i]
+		}
+		c.serverSig = hmacSHA256(hmacSHA256(salted, "Server Key"), authMessage)
+		return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+
+	case 2: // server-final-message
+		v, err := base64.StdEncoding.DecodeString(attr["v"])
+		if err != nil || !hmac.Equal(v, c.serverSig) {
+			return nil, fmt.Errorf("%w: bad server signature", ErrScram)
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("%w: unexpected message", ErrScram)
+}
+
+var ErrScram = fmt.Errorf("scram")
+
+// ----------------------------------------
+
+func hmacSHA256(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+// scramAttributes returns the key=value pairs of a message.
+func scramAttributes(msg string) map[string]string {
+	attr := make(map[string]string)
+	for _, kv := range strings.Split(msg, ",") {
+		k, v, found := strings.Cut(kv, "=")
+		if found {
+			attr[k] = v
+		}
+	}
+	return attr
+}
+
+func scramNonce() string {
+	b := make([]byte, 18)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// scramEscape encodes , and = in usernames, RFC 5802 section 5.1
+func scramEscape(v string) string {
+	v = strings.ReplaceAll(v, "=", "=3D")
+	return strings.ReplaceAll(v, ",", "=2C")
+}
+
+func scramUnescape(v string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.Index(v, "=")
+		if i < 0 {
+			b.WriteString(v)
+			return b.String(), nil
+		}
+		b.WriteString(v[:i])
+		switch {
+		case strings.HasPrefix(v[i:], "=2C"):
+			b.WriteByte(',')
+		case strings.HasPrefix(v[i:], "=3D"):
+			b.WriteByte('=')
+		default:
+			return "", fmt.Errorf("%w: bad username", ErrScram)
+		}
+		v = v[i+3:]
+	}
+}
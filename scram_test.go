@@ -0,0 +1,180 @@
+package tt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gregoryv/mq"
+	"github.com/gregoryv/tt/event"
+)
+
+func TestScram(t *testing.T) {
+	m := testScramMethod()
+	{ // valid, username with escaped characters
+		info, code, err := scramExchange(m, NewScramClient("a,b=c", "secret"))
+		if code != mq.Success || err != nil {
+			t.Fatal(code, err)
+		}
+		if info.Username != "a,b=c" {
+			t.Errorf("username %q", info.Username)
+		}
+	}
+	{ // wrong password
+		info, code, _ := scramExchange(m, NewScramClient("a,b=c", "wrong"))
+		if code != mq.NotAuthorized || info.Username != "" {
+			t.Error(code, info.Username)
+		}
+	}
+	{ // unknown user
+		_, code, _ := scramExchange(m, NewScramClient("nobody", "secret"))
+		if code != mq.NotAuthorized {
+			t.Error(code)
+		}
+	}
+	{ // client rejects a server not knowing the password
+		c := NewScramClient("a,b=c", "secret")
+		c.Start()
+		c.Next([]byte("r=" + c.nonce + "x,s=MDEy,i=1"))
+		if _, err := c.Next([]byte("v=MDEy")); err == nil {
+			t.Error("accepted bad server signature")
+		}
+	}
+}
+
+func TestServer_EnhancedAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	ln, _ := net.Listen("tcp", "localhost:")
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s := NewServer()
+	s.AddBind(&Bind{URL: "tcp://" + addr, AcceptTimeout: "10ms"})
+	s.AddAuthMethod(testScramMethod())
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	connect := func(password string) (*Client, mq.ReasonCode) {
+		t.Helper()
+		c := NewClient()
+		c.SetServer("tcp://" + addr)
+		c.SetAuthMethod(NewScramClient("a,b=c", password))
+		go c.Run(ctx)
+		for v := range c.Events() {
+			switch v := v.(type) {
+			case event.ClientUp:
+				c.Send(ctx, mq.NewConnect())
+			case *mq.ConnAck:
+				return c, v.ReasonCode()
+			case event.ClientStop:
+				t.Fatal(v.Err)
+			}
+		}
+		return c, 0
+	}
+
+	if _, code := connect("wrong"); code != mq.NotAuthorized {
+		t.Error("expected NotAuthorized, got", code)
+	}
+	c, code := connect("secret")
+	if code != mq.Success {
+		t.Fatal("expected Success, got", code)
+	}
+	if err := c.Reauthenticate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case v := <-c.Events():
+			if p, ok := v.(*mq.Auth); ok && p.ReasonCode() == mq.Success {
+				return
+			}
+		case <-timeout:
+			t.Fatal("no re-authentication")
+		}
+	}
+}
+
+func TestServer_BadAuthMethod(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	conn := pipeConn(ctx, s)
+	t.Cleanup(func() { conn.Close() })
+	p := mq.NewConnect()
+	p.SetAuthMethod("unknown")
+	p.WriteTo(conn)
+	a, _ := mq.ReadPacket(conn)
+	if a, ok := a.(*mq.ConnAck); !ok || a.ReasonCode() != mq.BadAuthenticationMethod {
+		t.Error("expected BadAuthenticationMethod, got", a)
+	}
+}
+
+// Clients not completing enhanced authentication in time are
+// disconnected.
+func TestServer_EnhancedAuthTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	s.SetConnectTimeout(20 * time.Millisecond)
+	s.AddAuthMethod(testScramMethod())
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	conn := pipeConn(ctx, s)
+	t.Cleanup(func() { conn.Close() })
+	c := NewScramClient("a,b=c", "secret")
+	data, _ := c.Start()
+	p := mq.NewConnect()
+	p.SetAuthMethod(c.Name())
+	p.SetAuthData(data)
+	p.WriteTo(conn)
+	if a, _ := mq.ReadPacket(conn); !isAuth(a) {
+		t.Fatal("expected Auth got", a)
+	}
+	// client goes silent
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := mq.ReadPacket(conn); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("connection still open")
+	}
+}
+
+func isAuth(p mq.Packet) bool {
+	_, ok := p.(*mq.Auth)
+	return ok
+}
+
+func testScramMethod() *ScramSHA256 {
+	cred := NewScramCredentials("secret", []byte("0123456789ab"), 4096)
+	return NewScramSHA256(func(username string) (*ScramCredentials, bool) {
+		return cred, username == "a,b=c"
+	})
+}
+
+// scramExchange runs the exchange between the method and client
+// returning the last server reason code.
+func scramExchange(m AuthMethod, c *ScramClient) (*ConnectInfo, mq.ReasonCode, error) {
+	ctx := context.Background()
+	info := &ConnectInfo{}
+	x := m.Start(ctx, info)
+	data, _ := c.Start()
+	for {
+		resp, code := x.Next(ctx, data)
+		if code >= 0x80 {
+			return info, code, nil
+		}
+		var err error
+		data, err = c.Next(resp)
+		if err != nil || code == mq.Success {
+			return info, code, err
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"net/url"
 	"os"
@@ -14,17 +15,27 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/gregoryv/mq"
 	"github.com/gregoryv/tt/event"
 )
 
 // NewServer returns a server ready to run. Configure any settings
 // before calling Run.
 func NewServer() *Server {
+	r := newRouter()
 	return &Server{
-		app:      make(chan interface{}, 1),
-		router:   newRouter(),
-		stat:     newServerStats(),
-		incoming: make(chan Connection, 1),
+		app:           make(chan interface{}, 1),
+		router:        r,
+		sessions:      newSessions(r),
+		clients:       newClients(),
+		retained:      newRetained(),
+		stat:          newServerStats(),
+		incoming:      make(chan Connection, 1),
+		maxQueued:     1000,
+		receiveMax:    math.MaxUint16,
+		topicAliasMax: 10,
+		outAliasMax:   10,
+		maxQoS:        2,
 	}
 }
 
@@ -35,12 +46,59 @@ type Server struct {
 	// before initial connect packet
 	connectTimeout time.Duration
 
+	// seconds, 0 means no limit
+	maxKeepAlive uint16
+
+	// outgoing QoS 0 publish packets queued per client
+	maxQueued int
+	overflow  Overflow
+
+	// incoming QoS 2 messages in flight per client
+	receiveMax uint16
+
+	// of incoming packets in bytes, 0 means no limit
+	maxPacketSize uint32
+
+	// per client for incoming publish packets
+	topicAliasMax uint16
+
+	// per client for outgoing publish packets, also limited by the
+	// client
+	outAliasMax uint16
+
+	// highest QoS supported, advertised in ConnAck if less than 2
+	maxQoS uint8
+
+	// how often $SYS/broker/... topics are published, 0 disables
+	sysInterval time.Duration
+
 	debug bool
 	log   *log.Logger
 
 	// routes publish packets to subscribing clients
 	router *router
 
+	// client sessions by client id
+	sessions *sessions
+
+	// connected clients by client id
+	clients *clients
+
+	// retained messages by topic name
+	retained *retained
+
+	// durable state
+	store Store
+
+	// decides if clients may connect, nil accepts all
+	auth Authenticator
+
+	// enhanced authentication methods by name
+	authMethods map[string]AuthMethod
+
+	// decides which topics clients may use, nil allows all
+	authz Authorizer
+
 	// statistics
 	stat *serverStats
 
@@ -66,6 +124,91 @@ func (s *Server) SetConnectTimeout(v time.Duration) {
 	s.connectTimeout = v
 }
 
+// SetMaxKeepAlive limits the keep alive of clients in seconds,
+// default 0 means no limit. Clients asking for a longer, or no, keep
+// alive are told to use this value by the Server Keep Alive property.
+func (s *Server) SetMaxKeepAlive(v uint16) {
+	s.maxKeepAlive = v
+}
+
+// SetMaxQueued limits the number of outgoing QoS 0 publish packets
+// queued for each client, default 1000. Zero or less means no
+// limit. QoS 1 and 2 packets are limited by the Receive Maximum of
+// each client.
+func (s *Server) SetMaxQueued(v int) {
+	s.maxQueued = v
+}
+
+// SetOverflow sets what happens when the queue of a client is full,
+// defaults to OverflowDropNewest. Dropped messages are reported as
+// event.ServerDropMessage.
+func (s *Server) SetOverflow(v Overflow) {
+	s.overflow = v
+}
+
+// SetReceiveMax limits the number of QoS 2 messages each client may
+// have in flight to the server, default 65535. Clients exceeding it
+// are disconnected with ReceiveMaximumExceeded.
+func (s *Server) SetReceiveMax(v uint16) {
+	s.receiveMax = v
+}
+
+// SetMaxPacketSize limits the size of packets sent by clients,
+// default 0 means no limit. Clients sending larger packets are
+// disconnected with PacketTooLarge.
+func (s *Server) SetMaxPacketSize(v uint32) {
+	s.maxPacketSize = v
+}
+
+// SetTopicAliasMax sets the number of topic aliases each client may
+// use when publishing, default 10. Zero disables incoming aliases, see
+// SetOutTopicAliasMax for messages sent to clients.
+func (s *Server) SetTopicAliasMax(v uint16) {
+	s.topicAliasMax = v
+}
+
+// SetOutTopicAliasMax sets the number of topic aliases the server
+// assigns to messages sent to each client, default 10. Limited by the
+// Topic Alias Maximum of the client. Zero disables outgoing aliases.
+func (s *Server) SetOutTopicAliasMax(v uint16) {
+	s.outAliasMax = v
+}
+
+// SetShareStrategy sets how messages are distributed among members
+// of shared subscriptions, defaults to round robin.
+func (s *Server) SetShareStrategy(v ShareStrategy) {
+	s.router.share = v
+}
+
+// SetStore sets the backend used to persist sessions and retained
+// messages, defaults to an in memory store. Stored state is loaded
+// when the server runs.
+func (s *Server) SetStore(v Store) {
+	s.store = v
+}
+
+// SetAuthenticator sets the authenticator used for each connecting
+// client, defaults to accepting all.
+func (s *Server) SetAuthenticator(v Authenticator) {
+	s.auth = v
+}
+
+// SetAuthorizer sets the authorizer consulted for each published
+// topic name and subscription filter, defaults to allowing all.
+func (s *Server) SetAuthorizer(v Authorizer) {
+	s.authz = v
+}
+
+// AddAuthMethod enables enhanced authentication using the given
+// method. Clients using it are authenticated by the method only, not
+// the authenticator.
+func (s *Server) AddAuthMethod(v AuthMethod) {
+	if s.authMethods == nil {
+		s.authMethods = make(map[string]AuthMethod)
+	}
+	s.authMethods[v.Name()] = v
+}
+
 // SetDebug increases log information, default false.
 func (s *Server) SetDebug(v bool) {
 	s.debug = v
@@ -76,6 +219,22 @@ func (s *Server) SetLogger(v *log.Logger) {
 	s.log = v
 }
 
+// Connected returns a copy of the information about the connected
+// client with the given id. The password is not included.
+func (s *Server) Connected(clientID string) (*ConnectInfo, bool) {
+	sc, found := s.clients.Get(clientID)
+	if !found {
+		return nil, false
+	}
+	return sc.public.Load().public(), true
+}
+
+// ConnectedIDs returns the sorted client IDs of all connected
+// clients.
+func (s *Server) ConnectedIDs() []string {
+	return s.clients.IDs()
+}
+
 // Events returns a channel used by server to inform the application
 // layer of events. E.g [event.ServerStop]
 func (s *Server) Events() <-chan interface{} {
@@ -98,11 +257,21 @@ func (s *Server) trigger(e any) {
 func (s *Server) Run(ctx context.Context) {
 	s.startup.Do(s.setDefaults)
 
+	if err := s.restore(); err != nil {
+		s.app <- event.ServerStop{err}
+		return
+	}
+
 	if err := s.runFeeds(ctx); err != nil {
 		s.app <- event.ServerStop{err}
 		return
 	}
 
+	s.stat.started = time.Now()
+	if s.sysInterval > 0 {
+		go s.runSys(ctx)
+	}
+
 	s.trigger(event.ServerUp(0))
 	for {
 		select {
@@ -124,6 +293,11 @@ func (s *Server) setDefaults() {
 	if s.debug {
 		s.log.SetFlags(s.log.Flags() | log.Lshortfile)
 	}
+	if s.store == nil {
+		s.store = NewMemStore()
+	}
+	s.sessions.store = s.store
+	s.sessions.log = s.log
 	if s.connectTimeout == 0 {
 		s.connectTimeout = 200 * time.Millisecond
 	}
@@ -135,6 +309,49 @@ func (s *Server) setDefaults() {
 	}
 }
 
+// restore loads sessions and retained messages from the store.
+func (s *Server) restore() error {
+	snap, err := s.store.Load()
+	if err != nil {
+		return err
+	}
+	for _, v := range snap.Retained {
+		if expired(v.Expires) {
+			if err := s.store.RemoveRetained(v.TopicName()); err != nil {
+				s.log.Print("store: ", err)
+			}
+			continue
+		}
+		s.retained.StoreUntil(v.Publish, v.Expires)
+	}
+	s.sessions.Restore(snap)
+	return nil
+}
+
+// retain stores the retained message, see 3.3.1.3 RETAIN
+func (s *Server) retain(p *mq.Publish) {
+	expires := expiresAt(p)
+	s.retained.StoreUntil(p, expires)
+	var err error
+	if len(p.Payload()) == 0 {
+		err = s.store.RemoveRetained(p.TopicName())
+	} else {
+		err = s.store.SaveRetained(StoredRetained{Publish: p, Expires: expires})
+	}
+	if err != nil {
+		s.log.Print("store: ", err)
+	}
+}
+
+// publish routes a message originating from the server, e.g. a will
+// message.
+func (s *Server) publish(ctx context.Context, p *mq.Publish) {
+	if p.Retain() {
+		s.retain(p)
+	}
+	_ = s.router.Route(ctx, p)
+}
+
 // runFeeds creates listeners for configured binds and runs them.
 func (s *Server) runFeeds(ctx context.Context) error {
 	for _, b := range s.binds {
@@ -143,7 +360,7 @@ func (s *Server) runFeeds(ctx context.Context) error {
 			return err
 		}
 
-		ln, err := net.Listen(u.Scheme, u.Host)
+		ln, err := b.listen(u)
 		if err != nil {
 			return err
 		}
@@ -168,7 +385,11 @@ func (s *Server) runFeeds(ctx context.Context) error {
 			Listener:      ln,
 			AcceptTimeout: t,
 		}
-		go f.Run(ctx)
+		go func() {
+			f.Run(ctx)
+			// e.g. removes unix socket files
+			ln.Close()
+		}()
 	}
 	return nil
 }
@@ -177,11 +398,58 @@ func (s *Server) runFeeds(ctx context.Context) error {
 
 // Bind holds server listening settings
 type Bind struct {
-	// eg. tcp://localhost[:port]
+	// eg. tcp://localhost[:port] or tls://localhost[:port], ssl://
+	// is the same as tls://. WebSocket binds ws:// and wss:// accept
+	// upgrades on the given path, any path if empty, e.g.
+	// ws://localhost:8080/mqtt. Unix domain sockets are given by
+	// path, e.g. unix:///run/tt.sock
 	URL string
 
 	// eg. 500ms
 	AcceptTimeout string
+
+	// PEM encoded certificate and key, required for tls:// and wss://
+	CertFile string
+	KeyFile  string
+
+	// optional PEM encoded certificate authorities, if set clients
+	// must present a certificate signed by one of them
+	ClientCAFile string
+
+	// permissions of the socket file for unix:// binds, defaults to
+	// 0660
+	SocketMode os.FileMode
+}
+
+// listen returns a listener for the scheme of u.
+func (b *Bind) listen(u *url.URL) (net.Listener, error) {
+	switch u.Scheme {
+	case "tls", "ssl", "wss":
+		cfg, err := b.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		ln, err := net.Listen("tcp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		tln := &tlsListener{TCPListener: ln.(*net.TCPListener), config: cfg}
+		if u.Scheme == "wss" {
+			return &wsListener{Listener: tln, path: u.Path}, nil
+		}
+		return tln, nil
+
+	case "ws":
+		ln, err := net.Listen("tcp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return &wsListener{Listener: ln, path: u.Path}, nil
+
+	case "unix":
+		return listenUnix(u.Path, b.SocketMode)
+	}
+	return net.Listen(u.Scheme, u.Host)
 }
 
 // ----------------------------------------
@@ -231,9 +499,23 @@ func newServerStats() *serverStats {
 	return &serverStats{}
 }
 
+// serverStats are published as $SYS/broker/... topics, see
+// [Server.SetSysInterval]. Counters are updated atomically.
 type serverStats struct {
+	// set when server runs
+	started time.Time
+
 	ConnCount  int64
 	ConnActive int64
+
+	// publish packets
+	MsgIn   int64
+	MsgOut  int64
+	Dropped int64
+
+	// all packets
+	BytesIn  int64
+	BytesOut int64
 }
 
 func (s *serverStats) AddConn() {
@@ -245,6 +527,13 @@ func (s *serverStats) RemoveConn() {
 	atomic.AddInt64(&s.ConnActive, -1)
 }
 
+func (s *serverStats) AddMsgIn()   { atomic.AddInt64(&s.MsgIn, 1) }
+func (s *serverStats) AddMsgOut()  { atomic.AddInt64(&s.MsgOut, 1) }
+func (s *serverStats) AddDropped() { atomic.AddInt64(&s.Dropped, 1) }
+
+func (s *serverStats) AddBytesIn(n int64)  { atomic.AddInt64(&s.BytesIn, n) }
+func (s *serverStats) AddBytesOut(n int64) { atomic.AddInt64(&s.BytesOut, n) }
+
 // ----------------------------------------
 
 func newSubscription(handlers ...pubHandler) *subscription {
@@ -257,9 +546,20 @@ func newSubscription(handlers ...pubHandler) *subscription {
 type subscription struct {
 	subscriptionID int
 
+	// client owning this subscription
+	clientID string
+
 	filters []string
 
+	// subscription options per filter, messages matching filters
+	// without options are delivered as published
+	options map[string]mq.Opt
+
 	handlers []pubHandler
+
+	// returns number of messages in flight to the client, used by
+	// shared subscription strategies, may be nil
+	inflight func() int
 }
 
 func (r *subscription) String() string {
@@ -278,6 +578,42 @@ func (s *subscription) addTopicFilter(f string) {
 	s.filters = append(s.filters, f)
 }
 
+// setOptions sets the subscription options of filter f.
+func (s *subscription) setOptions(f string, v mq.Opt) {
+	if s.options == nil {
+		s.options = make(map[string]mq.Opt)
+	}
+	s.options[f] = v
+}
+
+func (s *subscription) removeTopicFilter(f string) {
+	delete(s.options, f)
+	for i, v := range s.filters {
+		if v == f {
+			s.filters = append(s.filters[:i], s.filters[i+1:]...)
+			return
+		}
+	}
+}
+
+// deliveryOf returns QoS and retain flag for delivering p, published
+// by client from, according to the subscription options of filter
+// f. Returns false if p must not be delivered.
+//
+// See 3.8.3.1 Subscription Options
+func (s *subscription) deliveryOf(f, from string, p *mq.Publish) (qos uint8, retain, ok bool) {
+	o, found := s.options[f]
+	if !found {
+		return p.QoS(), p.Retain(), true
+	}
+	if o&mq.OptNL != 0 && from != "" && from == s.clientID {
+		return 0, false, false
+	}
+	qos = min(p.QoS(), uint8(o&mq.OptQoS3))
+	retain = p.Retain() && o&mq.OptRAP != 0
+	return qos, retain, true
+}
+
 // ----------------------------------------
 
 // https://docs.oasis-open.org/mqtt/mqtt/v5.0/os/mqtt-v5.0-os.html#_Toc3901247
@@ -285,6 +621,16 @@ func parseTopicFilter(filter string) error {
 	if len(filter) == 0 {
 		return fmt.Errorf("empty filter")
 	}
+	if name, f, ok := parseShared(filter); ok {
+		// 4.8.2 Shared Subscriptions
+		if name == "" || strings.ContainsAny(name, "+#") {
+			return fmt.Errorf("%q invalid share name", filter)
+		}
+		if f == "" {
+			return fmt.Errorf("%q missing shared filter", filter)
+		}
+		filter = f
+	}
 	for i, r := range filter {
 		switch r {
 		case '+':
@@ -0,0 +1,650 @@
+package tt
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gregoryv/mq"
+)
+
+func newSessions(r *router) *sessions {
+	return &sessions{
+		router: r,
+		store:  NewMemStore(),
+		log:    log.New(ioutil.Discard, "", 0),
+		byID:   make(map[string]*session),
+	}
+}
+
+// sessions keeps client sessions by client ID. Safe for concurrent
+// use.
+type sessions struct {
+	// subscriptions of expired sessions are removed from router
+	router *router
+
+	// durable sessions are persisted here
+	store Store
+
+	// store failures are logged
+	log *log.Logger
+
+	m    sync.Mutex
+	byID map[string]*session
+}
+
+// Start returns the session for the given client with sc
+// attached. An existing session is resumed unless cleanStart is true,
+// in which case it's discarded together with its
+// subscriptions. Returns true if an existing session is resumed.
+//
+// See 3.1.2.4 Clean Start
+func (s *sessions) Start(sc *sclient, cleanStart bool) (*session, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if sess, found := s.byID[sc.clientID]; found {
+		sess.stopExpiry()
+		// 3.1.3.2.2 a will is not sent if session is resumed
+		// before the delay, though if the session ends it is
+		sess.cancelWill(!cleanStart)
+		if !cleanStart {
+			sess.attach(sc)
+			return sess, true
+		}
+		s.discard(sess)
+	}
+	sess := s.newSession(sc.clientID)
+	sess.attach(sc)
+	s.byID[sc.clientID] = sess
+	return sess, false
+}
+
+// End detaches the client from its session. The session is
+// discarded once its expiry interval has passed.
+//
+// See 3.1.2.11.2 Session Expiry Interval
+func (s *sessions) End(sess *session, sc *sclient) {
+	if !sess.detach(sc) {
+		// another connection took over
+		return
+	}
+	s.expireLater(sess)
+}
+
+// Restore sessions with their subscriptions and in flight messages
+// from the store. Restored sessions are offline and expire unless
+// resumed.
+func (s *sessions) Restore(snap *Snapshot) {
+	for _, v := range snap.Sessions {
+		sess := s.newSession(v.ClientID)
+		sess.expiryInterval = v.ExpiryInterval
+		for _, f := range v.Subscriptions {
+			sub := newSubscription(sess.deliver)
+			sub.subscriptionID = f.SubscriptionID
+			sub.clientID = v.ClientID
+			sub.inflight = sess.inflightLen
+			sub.addTopicFilter(f.Filter)
+			sub.setOptions(f.Filter, f.Options)
+			s.router.AddSubscriptions(sub)
+		}
+		for _, m := range v.Messages {
+			if !m.Released && expired(m.Expires) {
+				// 3.3.2.3.3 the PubRel flow of released messages
+				// must complete
+				s.check(s.store.RemoveMessage(v.ClientID, m.PacketID()))
+				continue
+			}
+			sess.inflight.restore(m)
+		}
+		s.m.Lock()
+		s.byID[v.ClientID] = sess
+		s.m.Unlock()
+		s.expireLater(sess)
+	}
+}
+
+func (s *sessions) expireLater(sess *session) {
+	switch v := sess.ExpiryInterval(); v {
+	case 0:
+		s.remove(sess)
+	case math.MaxUint32:
+		// never expires
+	default:
+		sess.startExpiry(time.Duration(v)*time.Second, func() {
+			s.remove(sess)
+		})
+	}
+}
+
+// Get returns the session for the given client id.
+func (s *sessions) Get(clientID string) (*session, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	sess, found := s.byID[clientID]
+	return sess, found
+}
+
+// Len returns number of sessions, online and offline.
+func (s *sessions) Len() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return len(s.byID)
+}
+
+func (s *sessions) remove(sess *session) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.byID[sess.clientID] != sess || sess.online() {
+		// replaced by a new session or resumed
+		return
+	}
+	s.discard(sess)
+}
+
+// discard session and its subscriptions, caller must hold the lock.
+func (s *sessions) discard(sess *session) {
+	sess.cancelWill(false)
+	sess.end()
+	delete(s.byID, sess.clientID)
+	s.router.removeClient(sess.clientID)
+	if sess.ExpiryInterval() > 0 {
+		s.check(s.store.RemoveSession(sess.clientID))
+	}
+}
+
+func (s *sessions) newSession(clientID string) *session {
+	return &session{
+		clientID: clientID,
+		mgr:      s,
+		inflight: newInflight(),
+		received: make(map[uint16]struct{}),
+	}
+}
+
+// check logs store failures
+func (s *sessions) check(err error) {
+	if err != nil {
+		s.log.Print("store: ", err)
+	}
+}
+
+// ----------------------------------------
+
+// session holds the state of a client which may outlive the network
+// connection.
+//
+// See 4.1 Session State
+type session struct {
+	clientID string
+
+	// owning manager
+	mgr *sessions
+
+	m sync.Mutex
+
+	// seconds after disconnect the session expires
+	expiryInterval uint32
+	expiry         *time.Timer
+
+	// currently connected client, nil if offline
+	sc *sclient
+
+	// true once discarded, i.e. the session can no longer be resumed
+	ended bool
+
+	// outgoing QoS 1 and 2 packets waiting for acknowledgement,
+	// including those routed while client is offline
+	inflight *inflight
+
+	// incoming QoS 2 packet IDs waiting for PubRel
+	received map[uint16]struct{}
+
+	// delayed will message
+	will     *time.Timer
+	sendWill func()
+}
+
+// SetExpiryInterval sets the session expiry interval in seconds. Only
+// sessions with a non zero interval are persisted.
+func (s *session) SetExpiryInterval(v uint32) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if v == 0 && s.expiryInterval > 0 {
+		s.mgr.check(s.mgr.store.RemoveSession(s.clientID))
+	}
+	s.expiryInterval = v
+	if v > 0 {
+		s.mgr.check(s.mgr.store.SaveSession(s.clientID, v))
+	}
+}
+
+func (s *session) ExpiryInterval() uint32 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.expiryInterval
+}
+
+// durable returns true if session state should be persisted.
+func (s *session) durable() bool {
+	return s.expiryInterval > 0
+}
+
+// deliver transmits a routed publish packet to the connected client.
+// QoS 1 and 2 packets are copied and given a packet ID of their own
+// and kept until acknowledged. If the client is offline QoS 1 and 2
+// packets are kept for later and QoS 0 packets dropped.
+func (s *session) deliver(ctx context.Context, p *mq.Publish) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if p.QoS() == 0 {
+		if s.sc == nil || !s.sc.fits(p) {
+			return nil
+		}
+		return s.sc.transmit(ctx, p)
+	}
+
+	p = copyPublish(p)
+	o, err := s.inflight.add(p)
+	if err != nil {
+		return err
+	}
+	s.sendPending(ctx)
+	if !o.sent {
+		// saved by sendPending once sent
+		s.save(o)
+	}
+	return nil
+}
+
+// sendPending transmits unsent QoS 1 and 2 packets in order, as long
+// as the Receive Maximum of the client allows. Sent packets are saved
+// and expired packets discarded. Caller must hold the lock.
+//
+// See 4.9 Flow Control
+func (s *session) sendPending(ctx context.Context) {
+	if s.sc == nil {
+		// sent on resume
+		return
+	}
+	for s.inflight.sent < int(s.sc.receiveMax) {
+		o := s.inflight.next()
+		if o == nil {
+			return
+		}
+		p, ok := remaining(o.Publish, o.expires)
+		if !ok {
+			// 3.3.2.3.3 expired before onward delivery started
+			s.remove(o.PacketID())
+			continue
+		}
+		o.Publish = p
+		if !s.sc.fits(o.Publish) {
+			// 3.1.2.11.4 as if the message was sent and
+			// acknowledged
+			s.remove(o.PacketID())
+			continue
+		}
+		s.save(o)
+		_ = s.sc.transmit(ctx, o.Publish)
+	}
+}
+
+// inflightLen returns number of unacknowledged outgoing messages.
+func (s *session) inflightLen() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.inflight.Len()
+}
+
+// ack removes acknowledged packet, i.e. on PubAck or PubComp, and
+// sends pending packets.
+func (s *session) ack(ctx context.Context, id uint16) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if !s.remove(id) {
+		return
+	}
+	s.sendPending(ctx)
+}
+
+// remove packet from in flight and store, caller must hold the
+// lock.
+func (s *session) remove(id uint16) bool {
+	if !s.inflight.remove(id) {
+		return false
+	}
+	if s.durable() {
+		s.mgr.check(s.mgr.store.RemoveMessage(s.clientID, id))
+	}
+	return true
+}
+
+// release marks a QoS 2 packet as received by the client. Returns
+// false if no such packet is in flight.
+func (s *session) release(id uint16) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	o, found := s.inflight.get(id)
+	if !found {
+		return false
+	}
+	o.released = true
+	s.save(o)
+	return true
+}
+
+// save outgoing packet if session is durable, caller must hold lock.
+func (s *session) save(o *outgoing) {
+	if !s.durable() {
+		return
+	}
+	m := StoredMessage{
+		Publish:  o.Publish,
+		Sent:     o.sent,
+		Released: o.released,
+		Expires:  o.expires,
+	}
+	s.mgr.check(s.mgr.store.SaveMessage(s.clientID, m))
+}
+
+// saveSubscription persists filter of a durable session.
+func (s *session) saveSubscription(f mq.TopicFilter, subscriptionID int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if !s.durable() {
+		return
+	}
+	v := StoredSubscription{
+		Filter:         f.Filter(),
+		Options:        f.Options(),
+		SubscriptionID: subscriptionID,
+	}
+	s.mgr.check(s.mgr.store.SaveSubscription(s.clientID, v))
+}
+
+func (s *session) removeSubscription(filter string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if !s.durable() {
+		return
+	}
+	s.mgr.check(s.mgr.store.RemoveSubscription(s.clientID, filter))
+}
+
+// attach makes sc the connected client of this session.
+func (s *session) attach(sc *sclient) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.sc = sc
+}
+
+// detach returns false if sc is not the attached client.
+func (s *session) detach(sc *sclient) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.sc != sc {
+		return false
+	}
+	s.sc = nil
+	return true
+}
+
+// end detaches any client and marks the session as ended.
+func (s *session) end() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.sc = nil
+	s.ended = true
+}
+
+func (s *session) online() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.sc != nil
+}
+
+// resume retransmits unacknowledged packets and sends those routed
+// while the client was offline.
+//
+// See 4.4 Message delivery retry
+func (s *session) resume(ctx context.Context) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.sc == nil {
+		return
+	}
+	for _, o := range s.inflight.list() {
+		switch {
+		case o.released:
+			rel := mq.NewPubRel()
+			rel.SetPacketID(o.PacketID())
+			// not waiting for the write while holding the lock
+			s.sc.queue(rel)
+
+		case o.sent:
+			if p, ok := remaining(o.Publish, o.expires); ok {
+				o.Publish = p
+			}
+			o.SetDuplicate(true)
+			_ = s.sc.transmit(ctx, o.Publish)
+		}
+	}
+	s.sendPending(ctx)
+}
+
+// receivedQoS2 returns true the first time a QoS 2 packet ID is
+// received, until released. Returns ErrReceiveMax if max packets are
+// already waiting to be released.
+func (s *session) receivedQoS2(id uint16, max int) (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, found := s.received[id]; found {
+		return false, nil
+	}
+	if len(s.received) >= max {
+		return false, ErrReceiveMax
+	}
+	s.received[id] = struct{}{}
+	return true, nil
+}
+
+var ErrReceiveMax = fmt.Errorf("receive maximum exceeded")
+
+// releaseQoS2 returns false if the packet ID was not received.
+func (s *session) releaseQoS2(id uint16) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	_, found := s.received[id]
+	delete(s.received, id)
+	return found
+}
+
+// delayWill calls fn after the delay unless canceled. fn is called
+// right away if the session has ended and never if another client
+// than sc is attached, i.e. the session is already resumed.
+func (s *session) delayWill(sc *sclient, d time.Duration, fn func()) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	switch {
+	case s.ended:
+		// 3.1.3.2.2 sent when the session ends, if before the delay
+		go fn()
+
+	case s.sc != nil && s.sc != sc:
+		// resumed by another connection, the will is dropped
+
+	default:
+		s.sendWill = fn
+		s.will = time.AfterFunc(d, fn)
+	}
+}
+
+// cancelWill stops a delayed will message. The will is sent right
+// away unless drop is true.
+func (s *session) cancelWill(drop bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.will == nil {
+		return
+	}
+	stopped := s.will.Stop()
+	s.will = nil
+	if stopped && !drop {
+		go s.sendWill()
+	}
+}
+
+func (s *session) startExpiry(d time.Duration, fn func()) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.expiry = time.AfterFunc(d, fn)
+}
+
+func (s *session) stopExpiry() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+}
+
+// ----------------------------------------
+
+func newInflight() *inflight {
+	return &inflight{
+		packets: make(map[uint16]*outgoing),
+	}
+}
+
+// inflight tracks outgoing QoS 1 and 2 publish packets until they
+// are acknowledged. Not safe for concurrent use.
+type inflight struct {
+	last    uint16
+	count   uint64
+	packets map[uint16]*outgoing
+
+	// packets not yet sent, in the order they were added
+	unsent []*outgoing
+
+	// number of sent packets
+	sent int
+}
+
+type outgoing struct {
+	*mq.Publish
+
+	// order in which packets were added
+	seq uint64
+
+	// false if routed while client was offline
+	sent bool
+
+	// set once PubRec is received for QoS 2, i.e. waiting for PubComp
+	released bool
+
+	// zero if the message never expires
+	expires time.Time
+}
+
+// add sets an unused packet ID on p. Returns ErrPacketIDsInUse if
+// all ids are used.
+func (f *inflight) add(p *mq.Publish) (*outgoing, error) {
+	if len(f.packets) == math.MaxUint16 {
+		return nil, ErrPacketIDsInUse
+	}
+	for {
+		f.last++
+		if f.last == 0 {
+			continue
+		}
+		if _, found := f.packets[f.last]; !found {
+			break
+		}
+	}
+	p.SetPacketID(f.last)
+	f.count++
+	o := &outgoing{Publish: p, seq: f.count, expires: expiresAt(p)}
+	f.packets[f.last] = o
+	f.unsent = append(f.unsent, o)
+	return o, nil
+}
+
+// next marks the first unsent packet as sent. Returns nil if all are
+// sent.
+func (f *inflight) next() *outgoing {
+	for len(f.unsent) > 0 {
+		o := f.unsent[0]
+		f.unsent[0] = nil
+		f.unsent = f.unsent[1:]
+		if f.packets[o.PacketID()] != o {
+			// removed before sent
+			continue
+		}
+		o.sent = true
+		f.sent++
+		return o
+	}
+	return nil
+}
+
+// restore stored message. Messages not yet sent are queued in the
+// order they are restored.
+func (f *inflight) restore(m StoredMessage) {
+	id := m.PacketID()
+	f.count++
+	o := &outgoing{
+		Publish:  m.Publish,
+		seq:      f.count,
+		sent:     m.Sent || m.Released,
+		released: m.Released,
+		expires:  m.Expires,
+	}
+	f.packets[id] = o
+	if o.sent {
+		f.sent++
+	} else {
+		f.unsent = append(f.unsent, o)
+	}
+	f.last = max(f.last, id)
+}
+
+func (f *inflight) get(id uint16) (*outgoing, bool) {
+	o, found := f.packets[id]
+	return o, found
+}
+
+// remove returns false if no such packet is in flight.
+func (f *inflight) remove(id uint16) bool {
+	o, found := f.packets[id]
+	if found && o.sent {
+		f.sent--
+	}
+	delete(f.packets, id)
+	return found
+}
+
+// list returns packets in flight in the order they were added.
+func (f *inflight) list() []*outgoing {
+	res := make([]*outgoing, 0, len(f.packets))
+	for _, o := range f.packets {
+		res = append(res, o)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].seq < res[j].seq
+	})
+	return res
+}
+
+func (f *inflight) Len() int {
+	return len(f.packets)
+}
+
+var ErrPacketIDsInUse = fmt.Errorf("all packet IDs in use")
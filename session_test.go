@@ -0,0 +1,427 @@
+package tt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gregoryv/mq"
+)
+
+// Subscriptions and queued messages survive a reconnect within the
+// session expiry interval.
+func TestServer_ResumeSession(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+	s := NewServer()
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	connect := func() (net.Conn, *mq.ConnAck) {
+		conn := pipeConn(ctx, s)
+		t.Cleanup(func() { conn.Close() })
+		p := mq.NewConnect()
+		p.SetClientID("gateway")
+		p.SetSessionExpiryInterval(10)
+		p.WriteTo(conn)
+		a, _ := mq.ReadPacket(conn)
+		return conn, a.(*mq.ConnAck)
+	}
+	gw, a := connect()
+	if a.SessionPresent() {
+		t.Fatal("new session should not be present")
+	}
+	{ // subscribe
+		p := mq.NewSubscribe()
+		p.SetPacketID(1)
+		p.AddFilters(mq.NewTopicFilter("a/b", mq.OptQoS1))
+		p.WriteTo(gw)
+		_, _ = mq.ReadPacket(gw)
+	}
+	gw.Close()
+
+	{ // publish while gateway is offline
+		conn := pipeConn(ctx, s)
+		mq.NewConnect().WriteTo(conn)
+		_, _ = mq.ReadPacket(conn)
+		p := mq.Pub(1, "a/b", "hi")
+		p.SetPacketID(1)
+		p.WriteTo(conn)
+		_, _ = mq.ReadPacket(conn) // PubAck
+	}
+
+	gw, a = connect()
+	if !a.SessionPresent() {
+		t.Fatal("session should be present")
+	}
+	p, _ := mq.ReadPacket(gw)
+	if p, ok := p.(*mq.Publish); !ok || string(p.Payload()) != "hi" {
+		t.Error("expected queued publish got", p)
+	}
+}
+
+func Test_sessions_expire(t *testing.T) {
+	r := newRouter()
+	s := newSessions(r)
+	sc := &sclient{clientID: "a"}
+	sess, _ := s.Start(sc, false)
+	sess.SetExpiryInterval(0)
+	s.End(sess, sc)
+	if _, found := s.Get("a"); found {
+		t.Fatal("session with zero expiry remains")
+	}
+
+	sess, _ = s.Start(sc, false)
+	sess.SetExpiryInterval(1)
+	s.End(sess, sc)
+	if _, found := s.Get("a"); !found {
+		t.Fatal("session expired too early")
+	}
+	// resume before expiry
+	if _, present := s.Start(sc, false); !present {
+		t.Fatal("session not present")
+	}
+	s.End(sess, sc)
+	time.Sleep(1100 * time.Millisecond)
+	if v := s.Len(); v != 0 {
+		t.Error("session not expired")
+	}
+}
+
+func Test_inflight(t *testing.T) {
+	f := newInflight()
+	a := mq.Pub(1, "a", "")
+	b := mq.Pub(2, "b", "")
+	f.add(a)
+	f.add(b)
+	if a.PacketID() == b.PacketID() {
+		t.Fatal("same packet id used twice")
+	}
+	if l := f.list(); l[0].Publish != a {
+		t.Error("list not in order")
+	}
+	f.remove(a.PacketID())
+	f.remove(b.PacketID())
+	if _, found := f.get(b.PacketID()); found {
+		t.Error("found removed packet")
+	}
+	if v := f.Len(); v != 0 {
+		t.Error("expected empty, got", v)
+	}
+}
+
+// Sessions in the store are restored when the server runs.
+func TestServer_RestoreSessions(t *testing.T) {
+	store := NewMemStore()
+	store.SaveSession("gateway", 60)
+	store.SaveSubscription("gateway", StoredSubscription{
+		Filter: "a/b", Options: mq.OptQoS1,
+	})
+	p := mq.Pub(1, "a/b", "stored")
+	p.SetPacketID(3)
+	store.SaveMessage("gateway", StoredMessage{Publish: p, Sent: true})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	s.SetStore(store)
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	if !s.router.Subscribed("gateway", "a/b") {
+		t.Fatal("subscription not restored")
+	}
+	conn := pipeConn(ctx, s)
+	t.Cleanup(func() { conn.Close() })
+	{ // resume
+		p := mq.NewConnect()
+		p.SetClientID("gateway")
+		p.SetSessionExpiryInterval(60)
+		p.WriteTo(conn)
+		a, _ := mq.ReadPacket(conn)
+		if !a.(*mq.ConnAck).SessionPresent() {
+			t.Fatal("session not present")
+		}
+	}
+	{ // stored message is resent
+		p, _ := mq.ReadPacket(conn)
+		if p, ok := p.(*mq.Publish); !ok || !p.Duplicate() || p.PacketID() != 3 {
+			t.Fatal("expected duplicate of stored message, got", p)
+		}
+		ack := mq.NewPubAck()
+		ack.SetPacketID(3)
+		ack.WriteTo(conn)
+	}
+	// acknowledged message is removed from store
+	mq.NewPingReq().WriteTo(conn)
+	_, _ = mq.ReadPacket(conn)
+	snap, _ := store.Load()
+	if v := len(snap.Sessions[0].Messages); v != 0 {
+		t.Error("acknowledged message remains in store", v)
+	}
+}
+
+// Messages queued while the client was offline are sent within its
+// Receive Maximum after a restart.
+func TestServer_RestoreOfflineQueue(t *testing.T) {
+	store := NewMemStore()
+	store.SaveSession("gateway", 60)
+	for i := uint16(1); i <= 3; i++ {
+		p := mq.Pub(1, "a/b", "queued")
+		p.SetPacketID(i)
+		store.SaveMessage("gateway", StoredMessage{Publish: p})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	s.SetStore(store)
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	conn := pipeConn(ctx, s)
+	t.Cleanup(func() { conn.Close() })
+	{ // resume
+		p := mq.NewConnect()
+		p.SetClientID("gateway")
+		p.SetSessionExpiryInterval(60)
+		p.SetReceiveMax(1)
+		p.WriteTo(conn)
+		_, _ = mq.ReadPacket(conn)
+	}
+	for i := uint16(1); i <= 3; i++ {
+		p, _ := mq.ReadPacket(conn)
+		v, ok := p.(*mq.Publish)
+		if !ok || v.Duplicate() || v.PacketID() != i {
+			t.Fatal("expected first delivery of", i, "got", p)
+		}
+		snap, _ := store.Load()
+		if m := snap.Sessions[0].Messages[0]; !m.Sent {
+			t.Error("sent message not saved as sent", m.PacketID())
+		}
+		// nothing more until acknowledged
+		mq.NewPingReq().WriteTo(conn)
+		if p, _ := mq.ReadPacket(conn); !isPingResp(p) {
+			t.Fatal("expected PingResp got", p)
+		}
+		ack := mq.NewPubAck()
+		ack.SetPacketID(i)
+		ack.WriteTo(conn)
+	}
+}
+
+func TestServer_SessionTakeover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	connect := func() net.Conn {
+		t.Helper()
+		conn := pipeConn(ctx, s)
+		t.Cleanup(func() { conn.Close() })
+		p := mq.NewConnect()
+		p.SetClientID("pink")
+		p.SetSessionExpiryInterval(60)
+		p.WriteTo(conn)
+		a, _ := mq.ReadPacket(conn)
+		if a, ok := a.(*mq.ConnAck); !ok || a.ReasonCode() != mq.Success {
+			t.Fatal("expected ConnAck, got", a)
+		}
+		return conn
+	}
+	first := connect()
+	{
+		p := mq.NewSubscribe()
+		p.SetPacketID(1)
+		p.AddFilters(mq.NewTopicFilter("a/b", mq.OptQoS1))
+		p.WriteTo(first)
+		_, _ = mq.ReadPacket(first)
+	}
+	second := connect()
+
+	p, _ := mq.ReadPacket(first)
+	if p, ok := p.(*mq.Disconnect); !ok || p.ReasonCode() != mq.SessionTakenOver {
+		t.Fatal("expected SessionTakenOver, got", p)
+	}
+	if _, err := mq.ReadPacket(first); err == nil {
+		t.Error("first connection still open")
+	}
+
+	if ids := s.ConnectedIDs(); len(ids) != 1 || ids[0] != "pink" {
+		t.Error("connected", ids)
+	}
+	if v, found := s.Connected("pink"); !found || v.ClientID != "pink" {
+		t.Error("Connected", v, found)
+	}
+
+	// subscription was handed over
+	go s.publish(ctx, mq.Pub(1, "a/b", "hello"))
+	if p, _ := mq.ReadPacket(second); p == nil {
+		t.Error("expected publish on second connection")
+	}
+}
+
+// An unresponsive connection is closed when taken over.
+func TestServer_SessionTakeoverUnresponsive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	connect := func() net.Conn {
+		conn := pipeConn(ctx, s)
+		t.Cleanup(func() { conn.Close() })
+		p := mq.NewConnect()
+		p.SetClientID("pink")
+		p.WriteTo(conn)
+		_, _ = mq.ReadPacket(conn)
+		return conn
+	}
+	first := connect()
+	connect()
+
+	// first never reads the Disconnect
+	time.Sleep(takeOverTimeout + 100*time.Millisecond)
+	first.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := mq.NewPingReq().WriteTo(first)
+	if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("first connection still open", err)
+	}
+}
+
+func TestServer_ReceiveMaximum(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	s.SetReceiveMax(1)
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	sub := pipeConn(ctx, s)
+	t.Cleanup(func() { sub.Close() })
+	c := mq.NewConnect()
+	c.SetReceiveMax(1)
+	c.WriteTo(sub)
+	a, _ := mq.ReadPacket(sub)
+	if v := a.(*mq.ConnAck).ReceiveMax(); v != 1 {
+		t.Fatal("expected Receive Maximum 1 got", v)
+	}
+	{
+		p := mq.NewSubscribe()
+		p.SetPacketID(1)
+		p.AddFilters(mq.NewTopicFilter("a/#", mq.OptQoS1))
+		p.WriteTo(sub)
+		_, _ = mq.ReadPacket(sub)
+	}
+
+	pub := pipeConn(ctx, s)
+	t.Cleanup(func() { pub.Close() })
+	mq.NewConnect().WriteTo(pub)
+	_, _ = mq.ReadPacket(pub)
+	for i := uint16(1); i <= 2; i++ {
+		p := mq.Pub(1, "a/b", "hi")
+		p.SetPacketID(i)
+		p.WriteTo(pub)
+		_, _ = mq.ReadPacket(pub) // PubAck
+	}
+
+	first, _ := mq.ReadPacket(sub)
+	mq.NewPingReq().WriteTo(sub)
+	if p, _ := mq.ReadPacket(sub); !isPingResp(p) {
+		t.Fatal("expected PingResp before ack got", p)
+	}
+	ack := mq.NewPubAck()
+	ack.SetPacketID(first.(*mq.Publish).PacketID())
+	ack.WriteTo(sub)
+	if p, _ := mq.ReadPacket(sub); !isPublish(p) {
+		t.Fatal("expected second Publish got", p)
+	}
+
+	// incoming QoS 2 messages waiting for PubRel are limited
+	var p mq.Packet
+	for i := uint16(1); i <= 2; i++ {
+		v := mq.Pub(2, "x", "hi")
+		v.SetPacketID(i)
+		v.WriteTo(pub)
+		p, _ = mq.ReadPacket(pub)
+	}
+	if d, ok := p.(*mq.Disconnect); !ok || d.ReasonCode() != mq.ReceiveMaximumExceeded {
+		t.Error("expected ReceiveMaximumExceeded got", p)
+	}
+}
+
+func isPingResp(p mq.Packet) bool {
+	_, ok := p.(*mq.PingResp)
+	return ok
+}
+
+func isPublish(p mq.Packet) bool {
+	_, ok := p.(*mq.Publish)
+	return ok
+}
+
+// Resuming a session of a client not reading does not block routing.
+func TestServer_ResumeSlowClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	connect := func(id string) net.Conn {
+		conn := pipeConn(ctx, s)
+		t.Cleanup(func() { conn.Close() })
+		p := mq.NewConnect()
+		p.SetClientID(id)
+		p.SetSessionExpiryInterval(60)
+		p.WriteTo(conn)
+		_, _ = mq.ReadPacket(conn)
+		return conn
+	}
+	slow := connect("slow")
+	{
+		p := mq.NewSubscribe()
+		p.SetPacketID(1)
+		p.AddFilters(mq.NewTopicFilter("a", mq.OptQoS2))
+		p.WriteTo(slow)
+		_, _ = mq.ReadPacket(slow)
+	}
+	pub := connect("pub")
+	{
+		p := mq.Pub(2, "a", "hi")
+		p.SetPacketID(1)
+		p.WriteTo(pub)
+		_, _ = mq.ReadPacket(pub) // PubRec
+	}
+	{ // release without completing, PubRel is sent again on resume
+		p, _ := mq.ReadPacket(slow)
+		rec := mq.NewPubRec()
+		rec.SetPacketID(p.(*mq.Publish).PacketID())
+		rec.WriteTo(slow)
+		_, _ = mq.ReadPacket(slow) // PubRel
+		slow.Close()
+	}
+	connect("slow")                   // never reads after ConnAck
+	time.Sleep(20 * time.Millisecond) // let it resume
+
+	go func() {
+		p := mq.Pub(1, "a", "hi")
+		p.SetPacketID(2)
+		p.WriteTo(pub)
+	}()
+	pub.SetReadDeadline(time.Now().Add(time.Second))
+	p, err := mq.ReadPacket(pub)
+	if err != nil {
+		t.Fatal("routing blocked", err)
+	}
+	if _, ok := p.(*mq.PubAck); !ok {
+		t.Error("expected PubAck got", p)
+	}
+}
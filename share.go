@@ -0,0 +1,134 @@
+package tt
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync"
+
+	"github.com/gregoryv/mq"
+)
+
+// ShareStrategy selects which member of a shared subscription group
+// receives a message. Implementations must be safe for concurrent
+// use.
+//
+// See 4.8.2 Shared Subscriptions
+type ShareStrategy interface {
+	// Pick returns the index of the member to receive p. Share is
+	// the full filter, e.g. $share/workers/jobs/#, and members is
+	// never empty.
+	Pick(share string, p *mq.Publish, members []ShareMember) int
+}
+
+// ShareMember describes a client subscribing to a shared
+// subscription.
+type ShareMember struct {
+	ClientID string
+
+	// number of unacknowledged outgoing QoS 1 and 2 messages
+	Inflight int
+}
+
+// NewRoundRobinShare returns a strategy picking members in turn, this
+// is the default.
+func NewRoundRobinShare() *RoundRobinShare {
+	return &RoundRobinShare{turns: newTurns()}
+}
+
+type RoundRobinShare struct {
+	turns *turns
+}
+
+func (s *RoundRobinShare) Pick(share string, _ *mq.Publish, members []ShareMember) int {
+	return s.turns.take(share, len(members))
+}
+
+// NewRandomShare returns a strategy picking members at random.
+func NewRandomShare() *RandomShare {
+	return &RandomShare{}
+}
+
+type RandomShare struct{}
+
+func (s *RandomShare) Pick(_ string, _ *mq.Publish, members []ShareMember) int {
+	return rand.Intn(len(members))
+}
+
+// NewStickyShare returns a strategy picking members by a hash of the
+// topic name, i.e. messages of one topic go to the same member as
+// long as the group is unchanged.
+func NewStickyShare() *StickyShare {
+	return &StickyShare{}
+}
+
+type StickyShare struct{}
+
+func (s *StickyShare) Pick(_ string, p *mq.Publish, members []ShareMember) int {
+	h := fnv.New32a()
+	h.Write([]byte(p.TopicName()))
+	return int(h.Sum32() % uint32(len(members)))
+}
+
+// NewLeastInflightShare returns a strategy picking the member with
+// the fewest unacknowledged messages, ties are picked in turn.
+func NewLeastInflightShare() *LeastInflightShare {
+	return &LeastInflightShare{turns: newTurns()}
+}
+
+type LeastInflightShare struct {
+	turns *turns
+}
+
+func (s *LeastInflightShare) Pick(share string, _ *mq.Publish, members []ShareMember) int {
+	least := members[0].Inflight
+	for _, m := range members[1:] {
+		least = min(least, m.Inflight)
+	}
+	var idle []int
+	for i, m := range members {
+		if m.Inflight == least {
+			idle = append(idle, i)
+		}
+	}
+	return idle[s.turns.take(share, len(idle))]
+}
+
+func newTurns() *turns {
+	return &turns{next: make(map[string]int)}
+}
+
+// turns keeps a counter for each shared subscription.
+type turns struct {
+	m    sync.Mutex
+	next map[string]int
+}
+
+// take returns the next index in 0..n-1 for the given share.
+func (t *turns) take(share string, n int) int {
+	t.m.Lock()
+	defer t.m.Unlock()
+	i := t.next[share] % n
+	t.next[share] = i + 1
+	return i
+}
+
+// ----------------------------------------
+
+// parseShared splits a shared subscription filter
+// $share/{ShareName}/{filter}. Returns false if v is not shared.
+func parseShared(v string) (name, filter string, ok bool) {
+	rest, found := strings.CutPrefix(v, "$share/")
+	if !found {
+		return "", "", false
+	}
+	name, filter, _ = strings.Cut(rest, "/")
+	return name, filter, true
+}
+
+// shareGroup is a shared subscription with all its members.
+type shareGroup struct {
+	// topic filter without the $share/{ShareName}/ prefix
+	filter  string
+	members []*subscription
+}
@@ -0,0 +1,160 @@
+package tt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gregoryv/mq"
+)
+
+func TestServer_SharedSubscription(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	connect := func(id string) net.Conn {
+		conn := pipeConn(ctx, s)
+		t.Cleanup(func() { conn.Close() })
+		p := mq.NewConnect()
+		p.SetClientID(id)
+		p.WriteTo(conn)
+		a, _ := mq.ReadPacket(conn)
+		if a, ok := a.(*mq.ConnAck); !ok || !a.SharedSubAvailable() {
+			t.Fatal("expected shared subscriptions available", a)
+		}
+		return conn
+	}
+	subscribe := func(conn net.Conn, filter string) mq.ReasonCode {
+		p := mq.NewSubscribe()
+		p.SetPacketID(1)
+		p.AddFilters(mq.NewTopicFilter(filter, 0))
+		p.WriteTo(conn)
+		a, _ := mq.ReadPacket(conn)
+		if a, ok := a.(*mq.SubAck); ok {
+			return mq.ReasonCode(a.ReasonCodes()[0])
+		}
+		return mq.UnspecifiedError
+	}
+	a := connect("a")
+	b := connect("b")
+	for _, conn := range []net.Conn{a, b} {
+		if code := subscribe(conn, "$share/workers/jobs/#"); code != mq.Success {
+			t.Fatal("subscribe", code)
+		}
+	}
+
+	pub := connect("pub")
+	for i, member := range []net.Conn{a, b, a} {
+		mq.Pub(0, "jobs/1", "hi").WriteTo(pub)
+		member.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := mq.ReadPacket(member); err != nil {
+			t.Fatalf("message %v: %v", i, err)
+		}
+	}
+
+	// retained messages are not sent to shared subscriptions
+	p := mq.Pub(0, "jobs/2", "retained")
+	p.SetRetain(true)
+	p.WriteTo(pub)
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	_, _ = mq.ReadPacket(b)
+	c := connect("c")
+	subscribe(c, "$share/other/jobs/#")
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if p, err := mq.ReadPacket(c); err == nil {
+		t.Error("unexpected", p)
+	}
+}
+
+func Test_parseTopicFilter_shared(t *testing.T) {
+	for _, filter := range []string{
+		"$share/g/a/#", "$share/g/+",
+	} {
+		if err := parseTopicFilter(filter); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, filter := range []string{
+		"$share/", "$share/g", "$share/g/", "$share//a", "$share/g+/a",
+		"$share/#/a", "$share/g/a/#/b",
+	} {
+		if err := parseTopicFilter(filter); err == nil {
+			t.Errorf("%q expected error", filter)
+		}
+	}
+}
+
+func TestShareStrategy(t *testing.T) {
+	members := []ShareMember{
+		{ClientID: "a", Inflight: 2},
+		{ClientID: "b", Inflight: 1},
+		{ClientID: "c", Inflight: 1},
+	}
+	pick := func(s ShareStrategy, topics ...string) []int {
+		var picked []int
+		for _, topic := range topics {
+			p := mq.Pub(0, topic, "")
+			picked = append(picked, s.Pick("$share/g/#", p, members))
+		}
+		return picked
+	}
+	equal := func(got []int, exp ...int) bool {
+		if len(got) != len(exp) {
+			return false
+		}
+		for i := range got {
+			if got[i] != exp[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	if v := pick(NewRoundRobinShare(), "a", "a", "a", "a"); !equal(v, 0, 1, 2, 0) {
+		t.Error("round robin", v)
+	}
+	if v := pick(NewLeastInflightShare(), "a", "a", "a"); !equal(v, 1, 2, 1) {
+		t.Error("least inflight", v)
+	}
+	v := pick(NewStickyShare(), "x/y", "z", "x/y")
+	if v[0] != v[2] {
+		t.Error("sticky", v)
+	}
+	for _, i := range pick(NewRandomShare(), "a", "b", "c") {
+		if i < 0 || i >= len(members) {
+			t.Error("random out of range", i)
+		}
+	}
+}
+
+func Test_router_shared(t *testing.T) {
+	r := newRouter()
+	var got []string
+	for _, id := range []string{"a", "b"} {
+		s := mustNewSubscription("$share/g/a/+", func(_ context.Context, _ *mq.Publish) error {
+			got = append(got, id)
+			return nil
+		})
+		s.clientID = id
+		r.AddSubscriptions(s)
+	}
+	ctx := context.Background()
+	for _, topic := range []string{"a/1", "a/2", "b/1"} {
+		_ = r.Route(ctx, mq.Pub(0, topic, ""))
+	}
+	if len(got) != 2 || got[0] == got[1] {
+		t.Error("expected one message per member", got)
+	}
+	if !r.Subscribed("a", "$share/g/a/+") {
+		t.Error("a not subscribed", r)
+	}
+	r.removeClient("a")
+	r.removeClient("b")
+	if v := r.String(); v != "0 subscriptions" {
+		t.Error(v)
+	}
+}
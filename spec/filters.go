@@ -144,6 +144,10 @@ var RulesFilterMatching = []struct {
 
 	{false, "#", "$sys"},
 	{false, "+", "$sys"},
+	{false, "+/#", "$SYS/broker/uptime"},
+	{false, "+/broker/uptime", "$SYS/broker/uptime"},
+	{true, "$SYS/#", "$SYS/broker/uptime"},
+	{true, "$SYS/+/uptime", "$SYS/broker/uptime"},
 	{false, "a/b/+/#", "a/b"},
 	{false, "b/+/#", "a/b/c"},
 	{false, "a/+/+", "a/b/c/d"},
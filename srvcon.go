@@ -2,15 +2,19 @@ package tt
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gregoryv/mq"
+	"github.com/gregoryv/tt/event"
 )
 
 // serveConn handles the client connection.  Blocks until connection
@@ -25,24 +29,74 @@ func serveConn(ctx context.Context, s *Server, conn Connection) {
 	}
 	s.stat.AddConn()
 
+	// complete tls and websocket handshakes before reading packets,
+	// so client certificates are available when authenticating
+	if c, ok := conn.(handshaker); ok {
+		hctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+		err := c.HandshakeContext(hctx)
+		cancel()
+		if err != nil {
+			s.log.Println("del", connstr, err)
+			conn.Close()
+			s.stat.RemoveConn()
+			return
+		}
+	}
+
 	sc := &sclient{
-		// todo support client selected QoS when subscribing
-		maxQoS:   1,
+		maxQoS:   s.maxQoS,
 		maxIDLen: 11,
 		remote:   includePort(conn.RemoteAddr().String(), s.debug),
 		log:      s.log,
 		srv:      s,
 		conn:     conn,
+		out:      newOutQueue(s.maxQueued, s.overflow),
 	}
+	go sc.writer(ctx)
+
+	// 3.1.4 close connections not sending Connect in time
+	sc.connectTimer = time.AfterFunc(s.connectTimeout, func() {
+		sc.reject(ErrConnectTimeout)
+	})
 
 	// ignore error here, the Connection is done
-	err := newReceiver(sc.receive, conn).Run(ctx)
+	recv := newReceiver(sc.receive, &countingReader{
+		Reader: conn,
+		add:    s.stat.AddBytesIn,
+	})
+	recv.maxSize = s.maxPacketSize
+	err := recv.Run(ctx)
+	if errors.Is(err, ErrPacketTooLarge) {
+		// 3.2.2.2 and 3.14.2.1
+		if sc.sess == nil {
+			sc.refuse(ctx, mq.PacketTooLarge)
+		} else {
+			sc.disconnect(ctx, mq.PacketTooLarge)
+		}
+	}
+	sc.out.Close()
+	sc.stopConnectTimer()
+	if sc.keepAlive != nil {
+		sc.keepAlive.Stop()
+	}
 	if s.debug {
 		s.log.Println("del", connstr, err)
 	}
+	if sc.sess != nil {
+		s.clients.Unregister(sc)
+		sc.publishWill(ctx)
+		s.sessions.End(sc.sess, sc)
+	}
 	s.stat.RemoveConn()
 }
 
+// handshaker is implemented by e.g. tls.Conn
+type handshaker interface {
+	HandshakeContext(context.Context) error
+}
+
+const handshakeTimeout = 5 * time.Second
+
 func includePort(addr string, yes bool) string {
 	if yes {
 		return addr
@@ -68,31 +122,178 @@ type sclient struct {
 	maxQoS   uint8
 	maxIDLen uint
 
+	// outgoing QoS 1 and 2 messages in flight, see 4.9 Flow Control
+	receiveMax uint16
+
+	// of outgoing packets in bytes, 0 means no limit
+	maxPacketSize uint32
+
+	// topic aliases of incoming and outgoing publish packets, nil
+	// outAliases if the client does not accept aliases
+	aliases    topicAliases
+	outAliases *aliasLRU
+
 	remote string
 	log    *log.Logger
 	debug  bool
 
-	// sync transmitions
-	m    sync.Mutex
 	conn Connection
 
+	// packets written by the writer go routine
+	out *outQueue
+
+	// set once connected
+	sess *session
+
+	// the connect packet and client information, kept for
+	// authentication
+	connect      *mq.Connect
+	info         *ConnectInfo
+	connectTimer *time.Timer
+
+	// copy of info once authenticated, see Server.Connected
+	public atomic.Pointer[ConnectInfo]
+
+	// closes connections of silent clients, nil if no keep alive
+	keepAlive         *time.Timer
+	keepAliveInterval time.Duration
+
+	// ongoing enhanced authentication, see 4.12
+	authMethod string
+	authx      AuthExchange
+
+	// will message and delay in seconds, see 3.1.3.2 Will Properties
+	will      *mq.Publish
+	willDelay uint32
+
 	srv *Server
 }
 
+// transmit queues p for writing and blocks until written, except
+// for publish packets which may be dropped if the queue is full.
 func (sc *sclient) transmit(ctx context.Context, p mq.Packet) error {
-	sc.m.Lock()
-	defer sc.m.Unlock()
+	if p, ok := p.(*mq.Publish); ok {
+		dropped, ok := sc.out.Put(p, nil)
+		for _, d := range dropped {
+			sc.drop(d, "queue full")
+		}
+		if !ok {
+			// OverflowDisconnect
+			_ = sc.conn.Close()
+		}
+		if !ok || len(dropped) > 0 && dropped[0] == p {
+			return ErrQueueFull
+		}
+		return nil
+	}
+	done := make(chan error, 1)
+	sc.out.Put(p, done)
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	switch p := p.(type) {
+// queue adds p to the outgoing packets without waiting for it to be
+// written, e.g. when holding a lock.
+func (sc *sclient) queue(p mq.Packet) {
+	_, _ = sc.out.Put(p, nil)
+}
+
+var ErrQueueFull = fmt.Errorf("queue full")
+
+// fits returns false if p exceeds the Maximum Packet Size of the
+// client, in which case it's logged and reported as dropped.
+//
+// See 3.1.2.11.4 Maximum Packet Size
+func (sc *sclient) fits(p *mq.Publish) bool {
+	if sc.maxPacketSize == 0 {
+		return true
+	}
+	n, _ := p.WriteTo(io.Discard)
+	if n <= int64(sc.maxPacketSize) {
+		return true
+	}
+	sc.drop(p, fmt.Sprintf("%v bytes too large", n))
+	return false
+}
+
+// drop logs and reports p as not sent to the client.
+func (sc *sclient) drop(p *mq.Publish, reason string) {
+	sc.log.Printf("%s drop %s, %s", sc.from, p.TopicName(), reason)
+	sc.srv.stat.AddDropped()
+	sc.srv.trigger(event.ServerDropMessage{
+		ClientID:  sc.clientID,
+		TopicName: p.TopicName(),
+	})
+}
+
+// writer writes queued packets to the connection until the queue is
+// closed.
+func (sc *sclient) writer(ctx context.Context) {
+	for {
+		v, ok := sc.out.Next(ctx)
+		if !ok {
+			return
+		}
+		if p, ok := v.Packet.(*mq.Publish); ok {
+			// QoS 1 and 2 packets are in flight once queued and
+			// written even if expired
+			c, ok := remaining(p, v.expires)
+			switch {
+			case ok:
+				v.Packet = c
+			case p.QoS() == 0:
+				sc.drop(p, "expired")
+				continue
+			}
+		}
+		err := sc.write(v.Packet)
+		if v.done != nil {
+			v.done <- err
+		}
+		if err != nil {
+			sc.out.Close()
+			_ = sc.conn.Close()
+			return
+		}
+	}
+}
+
+func (sc *sclient) write(p mq.Packet) error {
+	switch v := p.(type) {
 	case *mq.ConnAck:
-		p.SetMaxQoS(sc.maxQoS)
+		// 3.2.2.3.4 absence of Maximum QoS means QoS 2 is supported
+		if sc.maxQoS < 2 {
+			v.SetMaxQoS(sc.maxQoS)
+		}
+
+	case *mq.Publish:
+		if sc.outAliases != nil {
+			// aliases are assigned in the order packets are
+			// written, on a copy as p may be sent to others
+			alias, known := sc.outAliases.assign(v.TopicName())
+			v = copyPublish(v)
+			v.SetTopicAlias(alias)
+			if known {
+				v.SetTopicName("")
+			}
+			p = v
+		}
 	}
 
 	sc.log.Printf("%s %v%s", sc.from, p, dump(sc.debug, p))
 
-	if _, err := p.WriteTo(sc.conn); err != nil {
+	n, err := p.WriteTo(sc.conn)
+	sc.srv.stat.AddBytesOut(n)
+	if err != nil {
 		return err
 	}
+	if _, ok := p.(*mq.Publish); ok {
+		sc.srv.stat.AddMsgOut()
+	}
 
 	switch p.(type) {
 	case *mq.Disconnect:
@@ -116,6 +317,44 @@ func (sc *sclient) receive(ctx context.Context, p mq.Packet) {
 	}
 
 	sc.log.Printf("%s %v%s (in)", sc.from, p, dump(sc.debug, p))
+	if sc.keepAlive != nil {
+		sc.keepAlive.Reset(sc.keepAliveInterval)
+	}
+
+	switch p.(type) {
+	case *mq.Connect:
+		if sc.connect != nil {
+			// 3.1.0-2 a second Connect is a protocol error
+			sc.disconnect(ctx, mq.ProtocolError)
+			sc.srv.trigger(event.ServerRejectConn{
+				Remote: sc.remote, Err: ErrSecondConnect,
+			})
+			return
+		}
+	default:
+		if sc.connect == nil {
+			// 3.1.0-1 the first packet must be Connect, closed
+			// without ConnAck as there is nothing to acknowledge
+			sc.reject(ErrConnectFirst)
+			return
+		}
+		switch p.(type) {
+		case *mq.Auth, *mq.PingReq, *mq.Disconnect:
+		default:
+			if sc.sess == nil {
+				// packets during authentication are ignored
+				return
+			}
+		}
+	}
+
+	if p, ok := p.(*mq.Publish); ok {
+		// topic name is empty when only the alias is used
+		if code := sc.aliases.resolve(p); code >= 0x80 {
+			sc.disconnect(ctx, code)
+			return
+		}
+	}
 
 	if p, ok := p.(interface{ WellFormed() *mq.Malformed }); ok {
 		if err := p.WellFormed(); err != nil {
@@ -132,20 +371,21 @@ func (sc *sclient) receive(ctx context.Context, p mq.Packet) {
 		_ = sc.transmit(ctx, mq.NewPingResp())
 
 	case *mq.Connect:
-		a := mq.NewConnAck()
-		if p.ClientID() == "" {
-			a.SetAssignedClientID(sc.clientID)
-		}
-		_ = sc.transmit(ctx, a)
-		// todo respect connectTimeout
+		sc.onConnect(ctx, p)
+
+	case *mq.Auth:
+		sc.onAuth(ctx, p)
 
 	case *mq.Subscribe:
 		a := mq.NewSubAck()
 		a.SetPacketID(p.PacketID())
-		sub := newSubscription(func(ctx context.Context, p *mq.Publish) error {
-			return sc.transmit(ctx, p)
-		})
+		sub := newSubscription(sc.sess.deliver)
 		sub.subscriptionID = p.SubscriptionID()
+		sub.clientID = sc.clientID
+		sub.inflight = sc.sess.inflightLen
+
+		// filters for which retained messages should be sent
+		var retain []mq.TopicFilter
 
 		// check all filters
 		for _, f := range p.Filters() {
@@ -157,16 +397,66 @@ func (sc *sclient) receive(ctx context.Context, p mq.Packet) {
 				_ = sc.transmit(ctx, p)
 				return
 			}
+			// authorize the filter of shared subscriptions
+			topic := filter
+			_, sharedFilter, shared := parseShared(filter)
+			if shared {
+				if f.Options()&mq.OptNL != 0 {
+					// 3.8.3.1 No Local on a shared subscription
+					sc.disconnect(ctx, mq.ProtocolError)
+					return
+				}
+				topic = sharedFilter
+			}
+			if code := sc.authorize(ctx, AccessRead, topic); code >= 0x80 {
+				a.AddReasonCode(code)
+				continue
+			}
+
+			// 3.9.3 the granted QoS may be lower than requested
+			qos := min(uint8(f.Options()&mq.OptQoS3), sc.maxQoS)
+			f.SetOptions(f.Options()&^mq.OptQoS3 | mq.Opt(qos))
+
+			// 3.3.1.3 Retain Handling, though retained messages are
+			// never sent for shared subscriptions, 4.8.2
+			if !shared {
+				exists := sc.srv.router.Subscribed(sc.clientID, filter)
+				switch retainHandling(f.Options()) {
+				case 0:
+					retain = append(retain, f)
+				case 1:
+					if !exists {
+						retain = append(retain, f)
+					}
+				}
+			}
 			sub.addTopicFilter(filter)
+			sub.setOptions(filter, f.Options())
+			sc.sess.saveSubscription(f, sub.subscriptionID)
 
 			// Subscribe.WellFormed fails if for any reason,
 			// though here we want to set a reason code for each
 			// filter.  3.9.3 SUBACK Payload
-			a.AddReasonCode(mq.Success)
+			a.AddReasonCode(mq.ReasonCode(qos))
 		}
 		sc.srv.router.AddSubscriptions(sub)
 		_ = sc.transmit(ctx, a)
 
+		// retained messages are sent with the retain flag set
+		for _, f := range retain {
+			qos := uint8(f.Options() & mq.OptQoS3)
+			for _, r := range sc.srv.retained.Match(f.Filter()) {
+				if r.QoS() > qos || sub.subscriptionID > 0 {
+					r = copyPublish(r)
+					r.SetQoS(min(r.QoS(), qos))
+					if sub.subscriptionID > 0 {
+						r.AddSubscriptionID(uint32(sub.subscriptionID))
+					}
+				}
+				_ = sc.sess.deliver(ctx, r)
+			}
+		}
+
 	case *mq.Unsubscribe:
 		// check all filters
 		filters := p.Filters()
@@ -179,14 +469,22 @@ func (sc *sclient) receive(ctx context.Context, p mq.Packet) {
 				return
 			}
 		}
-		sc.srv.router.removeFilters(sc, filters)
-		{
-			ack := mq.NewUnsubAck()
-			ack.SetPacketID(p.PacketID())
-			sc.transmit(ctx, ack)
+		existed := sc.srv.router.removeFilters(sc.clientID, filters)
+		ack := mq.NewUnsubAck()
+		ack.SetPacketID(p.PacketID())
+		for i, found := range existed {
+			if found {
+				sc.sess.removeSubscription(filters[i])
+				ack.AddReasonCode(mq.Success)
+				continue
+			}
+			ack.AddReasonCode(mq.NoSubscriptionExisted)
 		}
+		_ = sc.transmit(ctx, ack)
 
 	case *mq.Publish:
+		sc.srv.stat.AddMsgIn()
+
 		// Disconnect any attempts to publish exceeding qos.
 		// Specified in section 3.3.1.2 QoS
 		if p.QoS() > sc.maxQoS {
@@ -196,6 +494,12 @@ func (sc *sclient) receive(ctx context.Context, p mq.Packet) {
 			return
 		}
 
+		// 3.3.4 only the server sets subscription identifiers
+		if len(p.SubscriptionIDs()) > 0 {
+			sc.disconnect(ctx, mq.ProtocolError)
+			return
+		}
+
 		if err := parseTopicName(p.TopicName()); err != nil {
 			p := mq.NewDisconnect()
 			p.SetReasonCode(mq.MalformedPacket)
@@ -203,21 +507,382 @@ func (sc *sclient) receive(ctx context.Context, p mq.Packet) {
 			return
 		}
 
+		if code := sc.authorize(ctx, AccessWrite, p.TopicName()); code >= 0x80 {
+			sc.deny(ctx, p, code)
+			return
+		}
+
+		if p.Retain() {
+			sc.srv.retain(p)
+		}
+
 		switch p.QoS() {
 		case 0:
-			_ = sc.srv.router.Route(ctx, p)
+			_ = sc.srv.router.RouteFrom(ctx, sc.clientID, p)
 		case 1:
 			ack := mq.NewPubAck()
 			ack.SetPacketID(p.PacketID())
-			_ = sc.srv.router.Route(ctx, p)
+			_ = sc.srv.router.RouteFrom(ctx, sc.clientID, p)
 			_ = sc.transmit(ctx, ack)
 
 		case 2:
-			// todo support QoS 2
+			// 4.3.3 route only once, a duplicate is acknowledged
+			// again until released by PubRel
+			id := p.PacketID()
+			first, err := sc.sess.receivedQoS2(id, int(sc.srv.receiveMax))
+			if err != nil {
+				// 3.3.4 client exceeded the servers Receive Maximum
+				sc.disconnect(ctx, mq.ReceiveMaximumExceeded)
+				return
+			}
+			if first {
+				_ = sc.srv.router.RouteFrom(ctx, sc.clientID, p)
+			}
+			rec := mq.NewPubRec()
+			rec.SetPacketID(id)
+			_ = sc.transmit(ctx, rec)
+		}
 
+	case *mq.PubRel:
+		comp := mq.NewPubComp()
+		comp.SetPacketID(p.PacketID())
+		if !sc.sess.releaseQoS2(p.PacketID()) {
+			comp.SetReasonCode(mq.PacketIdentifierNotFound)
 		}
+		_ = sc.transmit(ctx, comp)
+
+	case *mq.PubAck:
+		sc.sess.ack(ctx, p.PacketID())
+
+	case *mq.PubRec:
+		if p.ReasonCode() >= 0x80 {
+			// 4.3.3 the receiver refused the message
+			sc.sess.ack(ctx, p.PacketID())
+			return
+		}
+		rel := mq.NewPubRel()
+		rel.SetPacketID(p.PacketID())
+		if !sc.sess.release(p.PacketID()) {
+			rel.SetReasonCode(mq.PacketIdentifierNotFound)
+		}
+		_ = sc.transmit(ctx, rel)
+
+	case *mq.PubComp:
+		sc.sess.ack(ctx, p.PacketID())
 
 	case *mq.Disconnect:
+		switch p.ReasonCode() {
+		case mq.NormalDisconnect:
+			// 3.1.2.5 will is removed on normal disconnect
+			sc.will = nil
+		case mq.DisconnectWithWill:
+			sc.willDelay = 0
+		}
 		_ = sc.conn.Close()
 	}
 }
+
+func (sc *sclient) onConnect(ctx context.Context, p *mq.Connect) {
+	// enhanced authentication must also complete in time, the timer
+	// is then stopped once accepted
+	if p.AuthMethod() == "" && !sc.stopConnectTimer() {
+		// timed out already
+		return
+	}
+	will, delay, err := willOf(p)
+	if err == nil && will != nil {
+		err = parseTopicName(will.TopicName())
+	}
+	if err != nil {
+		sc.refuse(ctx, mq.MalformedPacket)
+		return
+	}
+	sc.will = will
+	sc.willDelay = delay
+	sc.connect = p
+	sc.info = newConnectInfo(sc, p)
+
+	if name := p.AuthMethod(); name != "" {
+		m, found := sc.srv.authMethods[name]
+		if !found {
+			sc.refuse(ctx, mq.BadAuthenticationMethod)
+			return
+		}
+		sc.authMethod = name
+		sc.authx = m.Start(ctx, sc.info)
+		sc.exchange(ctx, p.AuthData())
+		return
+	}
+
+	if auth := sc.srv.auth; auth != nil {
+		if code := auth.Authenticate(ctx, sc.info); code >= 0x80 {
+			sc.refuse(ctx, code)
+			return
+		}
+	}
+	sc.accept(ctx, mq.NewConnAck())
+}
+
+// authorize returns mq.Success if the client may access the topic.
+func (sc *sclient) authorize(ctx context.Context, access Access, topic string) mq.ReasonCode {
+	authz := sc.srv.authz
+	if authz == nil {
+		return mq.Success
+	}
+	code := authz.Authorize(ctx, sc.info, access, topic)
+	if code >= 0x80 {
+		sc.log.Printf("%s %v %s: %v", sc.from, access, topic, code)
+	}
+	return code
+}
+
+// deny acknowledges a publish packet with the given reason code
+// without routing it. QoS 0 messages are silently dropped.
+func (sc *sclient) deny(ctx context.Context, p *mq.Publish, code mq.ReasonCode) {
+	switch p.QoS() {
+	case 1:
+		ack := mq.NewPubAck()
+		ack.SetPacketID(p.PacketID())
+		ack.SetReasonCode(code)
+		_ = sc.transmit(ctx, ack)
+	case 2:
+		rec := mq.NewPubRec()
+		rec.SetPacketID(p.PacketID())
+		rec.SetReasonCode(code)
+		_ = sc.transmit(ctx, rec)
+	}
+}
+
+func (sc *sclient) onAuth(ctx context.Context, p *mq.Auth) {
+	// 4.12.0-4 the method must be the same as in Connect
+	if sc.authMethod == "" || p.AuthMethod() != sc.authMethod {
+		sc.disconnect(ctx, mq.ProtocolError)
+		return
+	}
+	switch p.ReasonCode() {
+	case mq.ContinueAuth:
+		if sc.authx == nil {
+			sc.disconnect(ctx, mq.ProtocolError)
+			return
+		}
+		sc.exchange(ctx, p.AuthData())
+
+	case mq.ReAuthenticate:
+		// 4.12.1 re-authentication is only allowed once connected
+		if sc.sess == nil || sc.authx != nil {
+			sc.disconnect(ctx, mq.ProtocolError)
+			return
+		}
+		sc.authx = sc.srv.authMethods[sc.authMethod].Start(ctx, sc.info)
+		sc.exchange(ctx, p.AuthData())
+
+	default:
+		sc.disconnect(ctx, mq.ProtocolError)
+	}
+}
+
+// exchange passes authentication data from the client to the ongoing
+// enhanced authentication and responds with its result.
+func (sc *sclient) exchange(ctx context.Context, data []byte) {
+	resp, code := sc.authx.Next(ctx, data)
+	switch {
+	case code == mq.ContinueAuth:
+		a := mq.NewAuth()
+		a.SetReasonCode(mq.ContinueAuth)
+		a.SetAuthMethod(sc.authMethod)
+		a.SetAuthData(resp)
+		_ = sc.transmit(ctx, a)
+		return
+
+	case code >= 0x80:
+		sc.authx = nil
+		if sc.sess == nil {
+			sc.refuse(ctx, code)
+		} else {
+			// 4.12.1 failed re-authentication
+			sc.disconnect(ctx, code)
+		}
+		return
+	}
+
+	sc.authx = nil
+	if sc.sess == nil {
+		a := mq.NewConnAck()
+		a.SetAuthMethod(sc.authMethod)
+		a.SetAuthData(resp)
+		sc.accept(ctx, a)
+		return
+	}
+	// info may have changed on re-authentication
+	sc.public.Store(sc.info.public())
+	a := mq.NewAuth()
+	a.SetReasonCode(mq.Success)
+	a.SetAuthMethod(sc.authMethod)
+	a.SetAuthData(resp)
+	_ = sc.transmit(ctx, a)
+}
+
+// accept starts the session of an authenticated client and sends the
+// given ConnAck.
+func (sc *sclient) accept(ctx context.Context, a *mq.ConnAck) {
+	if !sc.stopConnectTimer() {
+		// timed out during enhanced authentication
+		return
+	}
+	if sc.will != nil {
+		code := sc.authorize(ctx, AccessWrite, sc.will.TopicName())
+		if code >= 0x80 {
+			sc.refuse(ctx, code)
+			return
+		}
+	}
+	p := sc.connect
+	// 3.1.2.11.3 absence of Receive Maximum means 65535
+	sc.receiveMax = p.ReceiveMax()
+	if sc.receiveMax == 0 {
+		sc.receiveMax = math.MaxUint16
+	}
+	sc.maxPacketSize = p.MaxPacketSize()
+	sc.aliases.max = sc.srv.topicAliasMax
+	if v := min(p.TopicAliasMax(), sc.srv.outAliasMax); v > 0 {
+		sc.outAliases = newAliasLRU(v)
+	}
+	sc.public.Store(sc.info.public())
+	old := sc.srv.clients.Register(sc)
+	sess, present := sc.srv.sessions.Start(sc, p.CleanStart())
+	sess.SetExpiryInterval(p.SessionExpiryInterval())
+	sc.sess = sess
+	if old != nil {
+		// 3.1.4-3 the session is already attached to sc, so the
+		// existing connection cannot end it. Not waiting for the old
+		// connection, which may be unresponsive.
+		go old.takenOver(ctx)
+	}
+
+	if p.ClientID() == "" {
+		a.SetAssignedClientID(sc.clientID)
+	}
+	if present {
+		// mq.ConnAck.SetSessionPresent sets the flag regardless
+		// of value
+		a.SetSessionPresent(true)
+	}
+	a.SetSharedSubAvailable(true)
+	if v := sc.srv.receiveMax; v < math.MaxUint16 {
+		a.SetReceiveMax(v)
+	}
+	if v := sc.srv.maxPacketSize; v > 0 {
+		a.SetMaxPacketSize(v)
+	}
+	if v := sc.srv.topicAliasMax; v > 0 {
+		a.SetTopicAliasMax(v)
+	}
+	keepAlive := p.KeepAlive()
+	if max := sc.srv.maxKeepAlive; max > 0 && (keepAlive == 0 || keepAlive > max) {
+		keepAlive = max
+		a.SetServerKeepAlive(max)
+	}
+	_ = sc.transmit(ctx, a)
+	if keepAlive > 0 {
+		sc.startKeepAlive(keepAlive)
+	}
+	if present {
+		sess.resume(ctx)
+	}
+}
+
+// startKeepAlive closes the connection if no packet is received
+// within one and a half times the keep alive, given in seconds. The
+// will message is published as for any network failure. See 3.1.2.10
+// Keep Alive
+func (sc *sclient) startKeepAlive(seconds uint16) {
+	sc.keepAliveInterval = time.Duration(seconds) * 1500 * time.Millisecond
+	sc.keepAlive = time.AfterFunc(sc.keepAliveInterval, func() {
+		sc.log.Printf("%s keep alive %vs exceeded", sc.from, seconds)
+		_ = sc.conn.Close()
+	})
+}
+
+// refuse responds to Connect with the given reason code and closes
+// the connection.
+func (sc *sclient) refuse(ctx context.Context, code mq.ReasonCode) {
+	a := mq.NewConnAck()
+	a.SetReasonCode(code)
+	_ = sc.transmit(ctx, a)
+	_ = sc.conn.Close()
+}
+
+// stopConnectTimer returns false if the connect timeout has passed.
+func (sc *sclient) stopConnectTimer() bool {
+	if sc.connectTimer == nil {
+		return true
+	}
+	stopped := sc.connectTimer.Stop()
+	sc.connectTimer = nil
+	return stopped
+}
+
+// reject closes the connection without any response and informs the
+// application.
+func (sc *sclient) reject(err error) {
+	_ = sc.conn.Close()
+	sc.srv.trigger(event.ServerRejectConn{Remote: sc.remote, Err: err})
+}
+
+var (
+	ErrConnectTimeout = fmt.Errorf("connect timeout")
+	ErrConnectFirst   = fmt.Errorf("first packet not connect")
+	ErrSecondConnect  = fmt.Errorf("second connect")
+)
+
+// disconnect sends Disconnect with the given reason code, which also
+// closes the connection.
+func (sc *sclient) disconnect(ctx context.Context, code mq.ReasonCode) {
+	d := mq.NewDisconnect()
+	d.SetReasonCode(code)
+	_ = sc.transmit(ctx, d)
+}
+
+// takenOver sends Disconnect SessionTakenOver and closes the
+// connection, also if the Disconnect cannot be written in time.
+func (sc *sclient) takenOver(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, takeOverTimeout)
+	defer cancel()
+	sc.disconnect(ctx, mq.SessionTakenOver)
+	_ = sc.conn.Close()
+}
+
+const takeOverTimeout = time.Second
+
+// publishWill publishes the will message of the client, if any, after
+// the Will Delay Interval or when the session ends whichever happens
+// first.
+func (sc *sclient) publishWill(ctx context.Context) {
+	will := sc.will
+	if will == nil {
+		return
+	}
+	sc.will = nil
+	delay := min(sc.willDelay, sc.sess.ExpiryInterval())
+	if delay == 0 {
+		sc.srv.publish(ctx, will)
+		return
+	}
+	// dropped if another connection resumed the session already
+	sc.sess.delayWill(sc, time.Duration(delay)*time.Second, func() {
+		sc.srv.publish(ctx, will)
+	})
+}
+
+// retainHandling returns the Retain Handling subscription option,
+// 0 send retained messages, 1 only for new subscriptions, 2 never.
+func retainHandling(o mq.Opt) uint8 {
+	return uint8(o>>4) & 0b11
+}
+
+// copyPublish returns a shallow copy of p, so that fields like packet
+// ID can be set per receiving client.
+func copyPublish(p *mq.Publish) *mq.Publish {
+	c := *p
+	return &c
+}
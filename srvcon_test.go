@@ -2,10 +2,14 @@ package tt
 
 import (
 	"context"
+	"errors"
 	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gregoryv/mq"
+	"github.com/gregoryv/tt/event"
 )
 
 // Server accepts subscribe followed by unsubscribe.
@@ -39,10 +43,61 @@ func TestServer_SubscribeThenUnsubscribe(t *testing.T) {
 	}
 	{ // verify ack
 		p, _ := mq.ReadPacket(conn)
-		if _, ok := p.(*mq.UnsubAck); !ok {
-			t.Errorf("expected UnsubAck got %T", p)
+		if p, ok := p.(*mq.UnsubAck); !ok || p.ReasonCodes()[0] != uint8(mq.Success) {
+			t.Errorf("expected successful UnsubAck got %v", p)
 		}
 	}
+	{ // unsubscribe again
+		p := mq.NewUnsubscribe()
+		p.SetPacketID(1)
+		p.AddFilter("a/b/#")
+		p.WriteTo(conn)
+	}
+	{ // verify ack
+		p, _ := mq.ReadPacket(conn)
+		if p := p.(*mq.UnsubAck); p.ReasonCodes()[0] != uint8(mq.NoSubscriptionExisted) {
+			t.Errorf("expected NoSubscriptionExisted got %v", p)
+		}
+	}
+}
+
+// Subscriptions are removed when the connection is closed.
+func TestServer_RemovesSubscriptionsOnClose(t *testing.T) {
+	ctx := context.Background()
+	s := NewServer()
+	ctx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	conn, srvconn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		serveConn(ctx, s, srvconn)
+		close(done)
+	}()
+	{ // initiate connect sequence
+		p := mq.NewConnect()
+		p.SetClientID("gopher")
+		p.WriteTo(conn)
+		// ignore ack
+		_, _ = mq.ReadPacket(conn)
+	}
+	{ // subscribe
+		p := mq.NewSubscribe()
+		p.SetPacketID(1)
+		p.AddFilters(mq.NewTopicFilter("a/b", mq.OptQoS1))
+		p.WriteTo(conn)
+		_, _ = mq.ReadPacket(conn)
+	}
+	if !s.router.Subscribed("gopher", "a/b") {
+		t.Fatal("missing subscription")
+	}
+	conn.Close()
+	<-done
+	if s.router.Subscribed("gopher", "a/b") {
+		t.Error("subscription remains after close")
+	}
 }
 
 // Server sends a disconnect when a client sends a subscribe
@@ -106,6 +161,42 @@ func TestServer_CloseConnectionOnDisconnect(t *testing.T) {
 	}
 }
 
+// Publish exceeding the maximum QoS of the server disconnects with
+// QoSNotSupported, 3.3.1.2 QoS
+func TestServer_DisconnectOnQoSExceed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	s.maxQoS = 1
+	go s.Run(ctx)
+	<-s.Events() // running
+	conn := pipeConn(ctx, s)
+	t.Cleanup(func() { conn.Close() })
+
+	{ // initiate connect sequence
+		mq.NewConnect().WriteTo(conn)
+		p, _ := mq.ReadPacket(conn)
+		if p := p.(*mq.ConnAck); p.MaxQoS() != 1 {
+			t.Error("expected Maximum QoS 1 got", p.MaxQoS())
+		}
+	}
+	{ // send publish with exceeding QoS
+		p := mq.Pub(2, "hello", "hi")
+		p.SetPacketID(1)
+		p.WriteTo(conn)
+	}
+	{ // check expected disconnect packet
+		p, _ := mq.ReadPacket(conn)
+		if p, ok := p.(*mq.Disconnect); !ok || p.ReasonCode() != mq.QoSNotSupported {
+			t.Error("expected QoSNotSupported got", p)
+		}
+	}
+	// verify the connection is closed
+	if _, err := mq.NewPublish().WriteTo(conn); err == nil {
+		t.Error("network Connection still open")
+	}
+}
+
 // If server gets a malformed packet it should disconnect with the
 // reason code MalformedPacket 0x81
 func TestServer_DisconnectOnMalformed(t *testing.T) {
@@ -134,32 +225,81 @@ func TestServer_DisconnectOnMalformed(t *testing.T) {
 	}
 }
 
-// Publish with exceeding QoS results in disconnect.
-func TestServer_DisconnectOnQoSExceed(t *testing.T) {
+// Publish using QoS 2 is routed once and released with PubRel.
+func TestServer_PublishQoS2(t *testing.T) {
 	ctx := context.Background()
 	conn, _ := setupClientServer(ctx, t)
 
 	{ // initiate connect sequence
 		mq.NewConnect().WriteTo(conn)
-		// ignore ack
-		_, _ = mq.ReadPacket(conn)
+		p, _ := mq.ReadPacket(conn)
+		if p := p.(*mq.ConnAck); p.MaxQoS() != 0 {
+			t.Error("ConnAck should not limit QoS", p.MaxQoS())
+		}
 	}
-	{ // send publish with exceeding QoS
-		p := mq.NewPublish()
+	{ // subscribe to what we publish
+		p := mq.NewSubscribe()
 		p.SetPacketID(1)
-		p.SetQoS(2)
-		p.SetTopicName("hello")
+		p.AddFilters(mq.NewTopicFilter("a/b", mq.OptQoS2))
 		p.WriteTo(conn)
+		_, _ = mq.ReadPacket(conn)
 	}
-	{ // check expected disconnect packet
+	pub := mq.Pub(2, "a/b", "hi")
+	pub.SetPacketID(2)
+	pub.WriteTo(conn)
+
+	var id uint16
+	{ // routed publish is delivered with an id set by the server
 		p, _ := mq.ReadPacket(conn)
-		if p := p.(*mq.Disconnect); p.ReasonCode() != mq.QoSNotSupported {
-			t.Error(p)
+		v, ok := p.(*mq.Publish)
+		if !ok || v.QoS() != 2 || v.PacketID() == 0 {
+			t.Fatal("expected QoS 2 Publish with packet id, got", p)
 		}
+		id = v.PacketID()
 	}
-	// verify the connection is closed
-	if _, err := mq.NewPublish().WriteTo(conn); err == nil {
-		t.Error("network Connection still open")
+	{ // publisher gets PubRec
+		p, _ := mq.ReadPacket(conn)
+		if p, ok := p.(*mq.PubRec); !ok || p.PacketID() != 2 {
+			t.Fatal("expected PubRec got", p)
+		}
+	}
+	{ // duplicate is only acknowledged
+		pub.SetDuplicate(true)
+		pub.WriteTo(conn)
+		p, _ := mq.ReadPacket(conn)
+		if _, ok := p.(*mq.PubRec); !ok {
+			t.Fatal("expected PubRec got", p)
+		}
+	}
+	{ // complete the outgoing flow
+		rec := mq.NewPubRec()
+		rec.SetPacketID(id)
+		rec.WriteTo(conn)
+		p, _ := mq.ReadPacket(conn)
+		if p, ok := p.(*mq.PubRel); !ok || p.PacketID() != id {
+			t.Fatal("expected PubRel got", p)
+		}
+		comp := mq.NewPubComp()
+		comp.SetPacketID(id)
+		comp.WriteTo(conn)
+	}
+	{ // release incoming
+		rel := mq.NewPubRel()
+		rel.SetPacketID(2)
+		rel.WriteTo(conn)
+		p, _ := mq.ReadPacket(conn)
+		if p, ok := p.(*mq.PubComp); !ok || p.ReasonCode() != mq.Success {
+			t.Fatal("expected PubComp got", p)
+		}
+	}
+	{ // second release is unknown
+		rel := mq.NewPubRel()
+		rel.SetPacketID(2)
+		rel.WriteTo(conn)
+		p, _ := mq.ReadPacket(conn)
+		if p := p.(*mq.PubComp); p.ReasonCode() != mq.PacketIdentifierNotFound {
+			t.Error(p)
+		}
 	}
 }
 
@@ -233,3 +373,316 @@ func setupClientServer(ctx context.Context, t *testing.T) (conn, srvconn net.Con
 	go serveConn(ctx, s, srvconn)
 	return
 }
+
+// Retained messages are sent to new subscriptions according to the
+// Retain Handling option.
+func TestServer_RetainedMessages(t *testing.T) {
+	ctx := context.Background()
+	conn, _ := setupClientServer(ctx, t)
+
+	{ // initiate connect sequence
+		mq.NewConnect().WriteTo(conn)
+		// ignore ack
+		_, _ = mq.ReadPacket(conn)
+	}
+	{ // publish retained message
+		p := mq.Pub(0, "a/b", "hi")
+		p.SetRetain(true)
+		p.WriteTo(conn)
+	}
+	subscribe := func(opt mq.Opt) {
+		p := mq.NewSubscribe()
+		p.SetPacketID(1)
+		p.AddFilters(mq.NewTopicFilter("a/+", opt))
+		p.WriteTo(conn)
+		if p, _ := mq.ReadPacket(conn); p == nil {
+			t.Fatal("missing SubAck")
+		}
+	}
+	{ // new subscription gets retained message
+		subscribe(mq.OptRetain1)
+		p, _ := mq.ReadPacket(conn)
+		if p, ok := p.(*mq.Publish); !ok || !p.Retain() {
+			t.Fatal("expected retained Publish got", p)
+		}
+	}
+	{ // existing subscription does not
+		subscribe(mq.OptRetain1)
+		// ping to see what comes next
+		mq.NewPingReq().WriteTo(conn)
+		p, _ := mq.ReadPacket(conn)
+		if _, ok := p.(*mq.PingResp); !ok {
+			t.Fatal("expected PingResp got", p)
+		}
+	}
+}
+
+// pipeConn returns the client side of a connection served by s.
+func pipeConn(ctx context.Context, s *Server) net.Conn {
+	conn, srvconn := net.Pipe()
+	go serveConn(ctx, s, srvconn)
+	return conn
+}
+
+func TestServer_ConnectRules(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	s.SetConnectTimeout(20 * time.Millisecond)
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	expectReject := func(exp error) {
+		t.Helper()
+		select {
+		case v := <-s.Events():
+			if v, ok := v.(event.ServerRejectConn); !ok || !errors.Is(v.Err, exp) {
+				t.Errorf("expected %v, got %v", exp, v)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("expected %v", exp)
+		}
+	}
+	{ // connect timeout
+		conn := pipeConn(ctx, s)
+		expectReject(ErrConnectTimeout)
+		if _, err := mq.ReadPacket(conn); err == nil {
+			t.Error("connection open after timeout")
+		}
+	}
+	{ // first packet must be connect
+		conn := pipeConn(ctx, s)
+		mq.NewPingReq().WriteTo(conn)
+		expectReject(ErrConnectFirst)
+		if _, err := mq.ReadPacket(conn); err == nil {
+			t.Error("connection open after ping")
+		}
+	}
+	{ // second connect
+		conn := pipeConn(ctx, s)
+		mq.NewConnect().WriteTo(conn)
+		_, _ = mq.ReadPacket(conn) // ConnAck
+		go mq.NewConnect().WriteTo(conn)
+		p, _ := mq.ReadPacket(conn)
+		if p, ok := p.(*mq.Disconnect); !ok || p.ReasonCode() != mq.ProtocolError {
+			t.Error("expected protocol error, got", p)
+		}
+		expectReject(ErrSecondConnect)
+	}
+}
+
+func TestServer_KeepAlive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	s.SetMaxKeepAlive(1)
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	sub := pipeConn(ctx, s)
+	t.Cleanup(func() { sub.Close() })
+	{
+		p := mq.NewConnect()
+		p.SetKeepAlive(0) // overridden
+		p.WriteTo(sub)
+		a, _ := mq.ReadPacket(sub)
+		if a, ok := a.(*mq.ConnAck); !ok || a.ServerKeepAlive() != 1 {
+			t.Fatal("expected Server Keep Alive 1, got", a)
+		}
+		s := mq.NewSubscribe()
+		s.SetPacketID(1)
+		s.AddFilters(mq.NewTopicFilter("will/#", 0))
+		s.WriteTo(sub)
+		_, _ = mq.ReadPacket(sub)
+	}
+
+	// silent client
+	conn := pipeConn(ctx, s)
+	t.Cleanup(func() { conn.Close() })
+	p := mq.NewConnect()
+	p.SetKeepAlive(60) // capped
+	p.SetWill(mq.Pub(0, "will/silent", "gone"), 0)
+	p.WriteTo(conn)
+	_, _ = mq.ReadPacket(conn)
+
+	// keep the subscriber alive with pings, while waiting for the
+	// will of the silent client
+	start := time.Now()
+	for {
+		mq.NewPingReq().WriteTo(sub)
+		p, err := mq.ReadPacket(sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, ok := p.(*mq.Publish); ok {
+			if p.TopicName() != "will/silent" {
+				t.Fatal("unexpected", p)
+			}
+			break
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Error("closed too early", d)
+	}
+	if _, err := mq.ReadPacket(conn); err == nil {
+		t.Error("silent client still connected")
+	}
+}
+
+func TestServer_SubscriptionOptions(t *testing.T) {
+	ctx := context.Background()
+	conn, _ := setupClientServer(ctx, t)
+	mq.NewConnect().WriteTo(conn)
+	_, _ = mq.ReadPacket(conn)
+
+	{ // subscribe
+		p := mq.NewSubscribe()
+		p.SetPacketID(1)
+		p.AddFilters(
+			mq.NewTopicFilter("own/#", mq.OptNL|mq.OptQoS1),
+			mq.NewTopicFilter("rap/#", mq.OptRAP|mq.OptQoS2),
+			mq.NewTopicFilter("norap/#", 0),
+		)
+		p.WriteTo(conn)
+		a, _ := mq.ReadPacket(conn)
+		v := a.(*mq.SubAck).ReasonCodes()
+		if len(v) != 3 || v[0] != 1 || v[1] != 2 || v[2] != 0 {
+			t.Fatal("expected granted QoS 1, 2 and 0, got", v)
+		}
+	}
+	publish := func(p mq.Packet) mq.Packet {
+		t.Helper()
+		p.WriteTo(conn)
+		got, err := mq.ReadPacket(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	retained := func(topic string) *mq.Publish {
+		p := mq.Pub(0, topic, "hi")
+		p.SetRetain(true)
+		return p
+	}
+
+	{ // No Local
+		mq.Pub(0, "own/a", "hi").WriteTo(conn)
+		if p, ok := publish(mq.NewPingReq()).(*mq.PingResp); !ok {
+			t.Fatal("expected PingResp got", p)
+		}
+	}
+	if p := publish(retained("rap/a")); !p.(*mq.Publish).Retain() {
+		t.Error("Retain As Published cleared retain flag", p)
+	}
+	if p := publish(retained("norap/a")); p.(*mq.Publish).Retain() {
+		t.Error("retain flag kept", p)
+	}
+	{ // delivered at granted QoS
+		p := mq.Pub(1, "norap/b", "hi")
+		p.SetPacketID(1)
+		if p := publish(p); p.(*mq.Publish).QoS() != 0 {
+			t.Error("expected QoS 0 got", p)
+		}
+		_, _ = mq.ReadPacket(conn) // PubAck
+	}
+}
+
+func TestServer_SubscriptionIdentifiers(t *testing.T) {
+	ctx := context.Background()
+	conn, _ := setupClientServer(ctx, t)
+	mq.NewConnect().WriteTo(conn)
+	_, _ = mq.ReadPacket(conn)
+
+	subscribe := func(id int, filter string, opt mq.Opt) {
+		p := mq.NewSubscribe()
+		p.SetPacketID(uint16(id))
+		p.SetSubscriptionID(id)
+		p.AddFilters(mq.NewTopicFilter(filter, opt))
+		p.WriteTo(conn)
+		_, _ = mq.ReadPacket(conn)
+	}
+	subscribe(1, "a/#", 0)
+	subscribe(2, "a/+", mq.OptQoS1)
+
+	p := mq.Pub(1, "a/b", "hi")
+	p.SetPacketID(1)
+	p.WriteTo(conn)
+	got, _ := mq.ReadPacket(conn)
+	v, ok := got.(*mq.Publish)
+	if !ok {
+		t.Fatal("expected Publish got", got)
+	}
+	ids := v.SubscriptionIDs()
+	if len(ids) != 2 || ids[0]+ids[1] != 3 || v.QoS() != 1 {
+		t.Error("expected one QoS 1 message with ids 1 and 2, got", v)
+	}
+	// a second message would be routed before the PubAck
+	got, _ = mq.ReadPacket(conn)
+	if _, ok := got.(*mq.PubAck); !ok {
+		t.Fatal("expected PubAck got", got)
+	}
+
+	// clients must not set subscription identifiers
+	p = mq.Pub(0, "a/b", "hi")
+	p.AddSubscriptionID(1)
+	p.WriteTo(conn)
+	got, _ = mq.ReadPacket(conn)
+	if d, ok := got.(*mq.Disconnect); !ok || d.ReasonCode() != mq.ProtocolError {
+		t.Error("expected ProtocolError got", got)
+	}
+}
+
+func TestServer_MaxPacketSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	s.SetMaxPacketSize(64)
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	sub := pipeConn(ctx, s)
+	t.Cleanup(func() { sub.Close() })
+	c := mq.NewConnect()
+	c.SetMaxPacketSize(30)
+	c.WriteTo(sub)
+	a, _ := mq.ReadPacket(sub)
+	if v := a.(*mq.ConnAck).MaxPacketSize(); v != 64 {
+		t.Fatal("expected Maximum Packet Size 64 got", v)
+	}
+	{
+		p := mq.NewSubscribe()
+		p.SetPacketID(1)
+		p.AddFilters(mq.NewTopicFilter("a/#", mq.OptQoS1))
+		p.WriteTo(sub)
+		_, _ = mq.ReadPacket(sub)
+	}
+
+	pub := pipeConn(ctx, s)
+	t.Cleanup(func() { pub.Close() })
+	mq.NewConnect().WriteTo(pub)
+	_, _ = mq.ReadPacket(pub)
+	big := strings.Repeat("x", 30)
+	for i, payload := range []string{big, "small", big, "small"} {
+		p := mq.Pub(uint8(i/2), "a/b", payload)
+		p.SetPacketID(uint16(i + 1))
+		p.WriteTo(pub)
+		if i >= 2 {
+			_, _ = mq.ReadPacket(pub) // PubAck
+		}
+	}
+	// oversized messages are dropped for the subscriber only
+	for i := 0; i < 2; i++ {
+		p, _ := mq.ReadPacket(sub)
+		if p, ok := p.(*mq.Publish); !ok || string(p.Payload()) != "small" {
+			t.Fatal("expected small message got", p)
+		}
+	}
+
+	// the server stops reading after the fixed header
+	go mq.Pub(0, "a/b", strings.Repeat("x", 64)).WriteTo(pub)
+	p, _ := mq.ReadPacket(pub)
+	if d, ok := p.(*mq.Disconnect); !ok || d.ReasonCode() != mq.PacketTooLarge {
+		t.Error("expected PacketTooLarge got", p)
+	}
+}
@@ -0,0 +1,293 @@
+package tt
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gregoryv/mq"
+)
+
+// Store persists server state that should survive a restart, i.e.
+// sessions with their subscriptions and in flight messages and
+// retained messages. Implementations must be safe for concurrent
+// use.
+type Store interface {
+	// SaveSession creates or updates a session.
+	SaveSession(clientID string, expiryInterval uint32) error
+
+	// RemoveSession removes the session including its subscriptions
+	// and messages.
+	RemoveSession(clientID string) error
+
+	SaveSubscription(clientID string, v StoredSubscription) error
+	RemoveSubscription(clientID, filter string) error
+
+	// SaveMessage creates or updates an outgoing message of a
+	// session, identified by its packet ID.
+	SaveMessage(clientID string, v StoredMessage) error
+	RemoveMessage(clientID string, packetID uint16) error
+
+	// SaveRetained stores the retained message of a topic.
+	SaveRetained(v StoredRetained) error
+	RemoveRetained(topicName string) error
+
+	// Load returns all stored state.
+	Load() (*Snapshot, error)
+}
+
+// Snapshot is the state loaded from a Store.
+type Snapshot struct {
+	Sessions []*StoredSession
+	Retained []StoredRetained
+}
+
+type StoredSession struct {
+	ClientID       string
+	ExpiryInterval uint32
+	Subscriptions  []StoredSubscription
+
+	// in the order they where first saved
+	Messages []StoredMessage
+}
+
+type StoredSubscription struct {
+	Filter         string
+	Options        mq.Opt
+	SubscriptionID int
+}
+
+// StoredMessage is an outgoing QoS 1 or 2 publish packet waiting for
+// acknowledgement.
+type StoredMessage struct {
+	*mq.Publish
+
+	// false if routed while the client was offline or beyond its
+	// Receive Maximum
+	Sent bool
+
+	// true if PubRec has been received
+	Released bool
+
+	// zero if the message never expires
+	Expires time.Time
+}
+
+// StoredRetained is the retained message of a topic.
+type StoredRetained struct {
+	*mq.Publish
+
+	// zero if the message never expires
+	Expires time.Time
+}
+
+// ----------------------------------------
+
+// NewMemStore returns an empty in memory store.
+func NewMemStore() *MemStore {
+	return &MemStore{
+		sessions: make(map[string]*memSession),
+		retained: make(map[string]*memRetained),
+	}
+}
+
+// MemStore keeps all state in memory, ie. nothing survives a
+// restart.
+type MemStore struct {
+	m        sync.Mutex
+	count    uint64
+	sessions map[string]*memSession
+	retained map[string]*memRetained // by topic name
+}
+
+type memSession struct {
+	expiryInterval uint32
+	subscriptions  map[string]StoredSubscription
+	messages       map[uint16]*memMessage
+}
+
+type memMessage struct {
+	seq      uint64
+	sent     bool
+	released bool
+	expires  time.Time
+	packet   []byte
+}
+
+type memRetained struct {
+	expires time.Time
+	packet  []byte
+}
+
+func (s *MemStore) SaveSession(clientID string, expiryInterval uint32) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.session(clientID).expiryInterval = expiryInterval
+	return nil
+}
+
+func (s *MemStore) RemoveSession(clientID string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.sessions, clientID)
+	return nil
+}
+
+func (s *MemStore) SaveSubscription(clientID string, v StoredSubscription) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.session(clientID).subscriptions[v.Filter] = v
+	return nil
+}
+
+func (s *MemStore) RemoveSubscription(clientID, filter string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if sess, found := s.sessions[clientID]; found {
+		delete(sess.subscriptions, filter)
+	}
+	return nil
+}
+
+func (s *MemStore) SaveMessage(clientID string, v StoredMessage) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	msgs := s.session(clientID).messages
+	id := v.PacketID()
+	if m, found := msgs[id]; found {
+		m.sent = v.Sent
+		m.released = v.Released
+		m.expires = v.Expires
+		m.packet = encode(v.Publish)
+		return nil
+	}
+	s.count++
+	msgs[id] = &memMessage{
+		seq:      s.count,
+		sent:     v.Sent,
+		released: v.Released,
+		expires:  v.Expires,
+		packet:   encode(v.Publish),
+	}
+	return nil
+}
+
+func (s *MemStore) RemoveMessage(clientID string, packetID uint16) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if sess, found := s.sessions[clientID]; found {
+		delete(sess.messages, packetID)
+	}
+	return nil
+}
+
+func (s *MemStore) SaveRetained(v StoredRetained) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.retained[v.TopicName()] = &memRetained{
+		expires: v.Expires,
+		packet:  encode(v.Publish),
+	}
+	return nil
+}
+
+func (s *MemStore) RemoveRetained(topicName string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.retained, topicName)
+	return nil
+}
+
+// Load returns sessions sorted by client id and retained messages
+// sorted by topic name.
+func (s *MemStore) Load() (*Snapshot, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var snap Snapshot
+	for clientID, sess := range s.sessions {
+		v := &StoredSession{
+			ClientID:       clientID,
+			ExpiryInterval: sess.expiryInterval,
+		}
+		for _, sub := range sess.subscriptions {
+			v.Subscriptions = append(v.Subscriptions, sub)
+		}
+		sort.Slice(v.Subscriptions, func(i, j int) bool {
+			return v.Subscriptions[i].Filter < v.Subscriptions[j].Filter
+		})
+
+		msgs := make([]*memMessage, 0, len(sess.messages))
+		for _, m := range sess.messages {
+			msgs = append(msgs, m)
+		}
+		sort.Slice(msgs, func(i, j int) bool {
+			return msgs[i].seq < msgs[j].seq
+		})
+		for _, m := range msgs {
+			p, err := decode(m.packet)
+			if err != nil {
+				return nil, err
+			}
+			v.Messages = append(v.Messages, StoredMessage{
+				Publish:  p,
+				Sent:     m.sent,
+				Released: m.released,
+				Expires:  m.expires,
+			})
+		}
+		snap.Sessions = append(snap.Sessions, v)
+	}
+	sort.Slice(snap.Sessions, func(i, j int) bool {
+		return snap.Sessions[i].ClientID < snap.Sessions[j].ClientID
+	})
+
+	for _, r := range s.retained {
+		p, err := decode(r.packet)
+		if err != nil {
+			return nil, err
+		}
+		snap.Retained = append(snap.Retained, StoredRetained{
+			Publish: p,
+			Expires: r.expires,
+		})
+	}
+	sort.Slice(snap.Retained, func(i, j int) bool {
+		return snap.Retained[i].TopicName() < snap.Retained[j].TopicName()
+	})
+	return &snap, nil
+}
+
+// session returns existing or new session, caller must hold lock.
+func (s *MemStore) session(clientID string) *memSession {
+	sess, found := s.sessions[clientID]
+	if !found {
+		sess = &memSession{
+			subscriptions: make(map[string]StoredSubscription),
+			messages:      make(map[uint16]*memMessage),
+		}
+		s.sessions[clientID] = sess
+	}
+	return sess
+}
+
+// encode returns the wire format of p.
+func encode(p *mq.Publish) []byte {
+	var buf bytes.Buffer
+	p.WriteTo(&buf)
+	return buf.Bytes()
+}
+
+func decode(data []byte) (*mq.Publish, error) {
+	p, err := mq.ReadPacket(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	v, ok := p.(*mq.Publish)
+	if !ok {
+		return nil, fmt.Errorf("decode: unexpected %T", p)
+	}
+	return v, nil
+}
@@ -0,0 +1,70 @@
+package tt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gregoryv/mq"
+)
+
+func TestMemStore(t *testing.T) {
+	testStore(t, NewMemStore())
+}
+
+// testStore verifies a store implementation keeps the state.
+func testStore(t *testing.T, s Store) {
+	t.Helper()
+	s.SaveSession("a", 10)
+	s.SaveSession("b", 20)
+	s.SaveSubscription("a", StoredSubscription{Filter: "a/#", Options: mq.OptQoS1})
+	s.SaveSubscription("a", StoredSubscription{Filter: "b/#"})
+	s.RemoveSubscription("a", "b/#")
+
+	p := mq.Pub(1, "a/b", "hi")
+	p.SetPacketID(7)
+	s.SaveMessage("a", StoredMessage{Publish: p})
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.SaveMessage("a", StoredMessage{
+		Publish: p, Sent: true, Released: true, Expires: expires,
+	})
+	q := mq.Pub(2, "a/c", "hi")
+	q.SetPacketID(8)
+	s.SaveMessage("a", StoredMessage{Publish: q})
+	s.RemoveMessage("a", 8)
+	s.RemoveSession("b")
+
+	r := mq.Pub(0, "a/r", "retained")
+	s.SaveRetained(StoredRetained{Publish: r, Expires: expires})
+	s.SaveRetained(StoredRetained{Publish: mq.Pub(0, "a/x", "gone")})
+	s.RemoveRetained("a/x")
+
+	snap, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.Sessions) != 1 {
+		t.Fatal("expected 1 session, got", len(snap.Sessions))
+	}
+	sess := snap.Sessions[0]
+	if sess.ClientID != "a" || sess.ExpiryInterval != 10 {
+		t.Error("unexpected session", sess)
+	}
+	if len(sess.Subscriptions) != 1 || sess.Subscriptions[0].Options != mq.OptQoS1 {
+		t.Error("unexpected subscriptions", sess.Subscriptions)
+	}
+	if len(sess.Messages) != 1 || !sess.Messages[0].Sent || !sess.Messages[0].Released {
+		t.Error("unexpected messages", sess.Messages)
+	}
+	if m := sess.Messages[0]; m.PacketID() != 7 || string(m.Payload()) != "hi" {
+		t.Error("unexpected message", m)
+	}
+	if m := sess.Messages[0]; !m.Expires.Equal(expires) {
+		t.Error("unexpected message expiry", m.Expires)
+	}
+	if len(snap.Retained) != 1 || snap.Retained[0].TopicName() != "a/r" {
+		t.Fatal("unexpected retained", snap.Retained)
+	}
+	if v := snap.Retained[0].Expires; !v.Equal(expires) {
+		t.Error("unexpected retained expiry", v)
+	}
+}
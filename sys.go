@@ -0,0 +1,66 @@
+package tt
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/gregoryv/mq"
+)
+
+// SetSysInterval sets how often broker statistics are published as
+// retained messages on $SYS/broker/... topics, default 0 disables
+// them. Topics starting with $ are not matched by filters starting
+// with a wildcard, i.e. clients subscribe to e.g. $SYS/#.
+func (s *Server) SetSysInterval(v time.Duration) {
+	s.sysInterval = v
+}
+
+// runSys publishes statistics every sysInterval until the context is
+// done.
+func (s *Server) runSys(ctx context.Context) {
+	tick := time.NewTicker(s.sysInterval)
+	defer tick.Stop()
+	for {
+		s.publishSys(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func (s *Server) publishSys(ctx context.Context) {
+	for _, v := range s.sysTopics() {
+		p := mq.Pub(0, "$SYS/broker/"+v.name, fmt.Sprint(v.value))
+		p.SetRetain(true)
+		// not persisted as values are published again on start
+		s.retained.Store(p)
+		_ = s.router.Route(ctx, p)
+	}
+}
+
+type sysTopic struct {
+	name  string
+	value int64
+}
+
+// sysTopics returns current statistics by topic name relative to
+// $SYS/broker/.
+func (s *Server) sysTopics() []sysTopic {
+	st := s.stat
+	return []sysTopic{
+		{"uptime", int64(time.Since(st.started).Seconds())},
+		{"clients/connected", atomic.LoadInt64(&st.ConnActive)},
+		{"clients/total", atomic.LoadInt64(&st.ConnCount)},
+		{"messages/received", atomic.LoadInt64(&st.MsgIn)},
+		{"messages/sent", atomic.LoadInt64(&st.MsgOut)},
+		{"messages/dropped", atomic.LoadInt64(&st.Dropped)},
+		{"bytes/received", atomic.LoadInt64(&st.BytesIn)},
+		{"bytes/sent", atomic.LoadInt64(&st.BytesOut)},
+		{"subscriptions/count", int64(s.router.Len())},
+		{"retained/count", int64(s.retained.Len())},
+	}
+}
@@ -0,0 +1,75 @@
+package tt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gregoryv/mq"
+)
+
+func TestServer_SysTopics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	s.SetSysInterval(10 * time.Millisecond)
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	connect := func(filters ...string) net.Conn {
+		conn := pipeConn(ctx, s)
+		t.Cleanup(func() { conn.Close() })
+		mq.NewConnect().WriteTo(conn)
+		_, _ = mq.ReadPacket(conn)
+		p := mq.NewSubscribe()
+		p.SetPacketID(1)
+		for _, f := range filters {
+			p.AddFilters(mq.NewTopicFilter(f, 0))
+		}
+		p.WriteTo(conn)
+		_, _ = mq.ReadPacket(conn) // SubAck
+		return conn
+	}
+	all := connect("#", "+/#")
+	sys := connect("$SYS/broker/clients/connected")
+
+	// values are published periodically
+	sys.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		p, err := mq.ReadPacket(sys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, ok := p.(*mq.Publish); ok && string(p.Payload()) == "2" {
+			break
+		}
+	}
+
+	// 4.7.2-1 not matched by filters starting with a wildcard
+	time.Sleep(30 * time.Millisecond)
+	mq.NewPingReq().WriteTo(all)
+	if p, _ := mq.ReadPacket(all); !isPingResp(p) {
+		t.Error("expected no $SYS messages got", p)
+	}
+}
+
+func TestServer_sysTopics(t *testing.T) {
+	s := NewServer()
+	s.stat.AddMsgIn()
+	s.stat.AddBytesOut(10)
+	s.retained.Store(mq.Pub(0, "a", "hi"))
+	got := make(map[string]int64)
+	for _, v := range s.sysTopics() {
+		got[v.name] = v.value
+	}
+	for name, exp := range map[string]int64{
+		"messages/received": 1,
+		"bytes/sent":        10,
+		"retained/count":    1,
+	} {
+		if got[name] != exp {
+			t.Errorf("%s: expected %v got %v", name, exp, got[name])
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package tt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// tlsConfig returns server configuration using the certificate files
+// of the bind.
+func (b *Bind) tlsConfig() (*tls.Config, error) {
+	if b.CertFile == "" || b.KeyFile == "" {
+		return nil, fmt.Errorf("%s: %w", b.URL, ErrMissingCert)
+	}
+	cert, err := tls.LoadX509KeyPair(b.CertFile, b.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if b.ClientCAFile != "" {
+		data, err := os.ReadFile(b.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no certificates found", b.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+var ErrMissingCert = fmt.Errorf("missing certificate or key file")
+
+// tlsListener wraps accepted connections in tls.Server. Unlike the
+// listener of tls.NewListener it keeps the SetDeadline method used by
+// connFeed.
+type tlsListener struct {
+	*net.TCPListener
+	config *tls.Config
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.TCPListener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(conn, l.config), nil
+}
+
+// peerCertificate returns the verified client certificate of a tls
+// connection, nil if there is none.
+func peerCertificate(conn Connection) *x509.Certificate {
+	c, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return nil
+	}
+	chains := c.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil
+	}
+	return chains[0][0]
+}
@@ -0,0 +1,153 @@
+package tt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gregoryv/mq"
+)
+
+func TestServer_TLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil)
+	srvCert := newTestCert(t, dir, "localhost", ca)
+	device := newTestCert(t, dir, "device1", ca)
+
+	ln, _ := net.Listen("tcp", "localhost:")
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	s.AddBind(&Bind{
+		URL:           "tls://" + addr,
+		AcceptTimeout: "10ms",
+		CertFile:      srvCert.certFile,
+		KeyFile:       srvCert.keyFile,
+		ClientCAFile:  ca.certFile,
+	})
+	var commonName string
+	s.SetAuthenticator(AuthenticatorFunc(
+		func(_ context.Context, v *ConnectInfo) mq.ReasonCode {
+			if v.Certificate == nil {
+				return mq.NotAuthorized
+			}
+			commonName = v.Certificate.Subject.CommonName
+			return mq.Success
+		},
+	))
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	{ // with client certificate
+		conn, err := tls.Dial("tcp", addr, &tls.Config{
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{device.pair},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		mq.NewConnect().WriteTo(conn)
+		p, err := mq.ReadPacket(conn)
+		if a, ok := p.(*mq.ConnAck); !ok || a.ReasonCode() != mq.Success {
+			t.Fatal("expected ConnAck, got", p, err)
+		}
+		if commonName != "device1" {
+			t.Errorf("common name %q", commonName)
+		}
+	}
+	{ // without client certificate
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots})
+		if err == nil {
+			defer conn.Close()
+			mq.NewConnect().WriteTo(conn)
+			if _, err = mq.ReadPacket(conn); err == nil {
+				t.Error("connected without client certificate")
+			}
+		}
+	}
+}
+
+func TestBind_tlsConfig(t *testing.T) {
+	b := &Bind{URL: "tls://localhost:"}
+	if _, err := b.tlsConfig(); err == nil {
+		t.Error("expected error without files")
+	}
+	b.CertFile = "no/such/file"
+	b.KeyFile = "no/such/file"
+	if _, err := b.tlsConfig(); err == nil {
+		t.Error("expected error for missing files")
+	}
+}
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	pair     tls.Certificate
+	certFile string
+	keyFile  string
+}
+
+// newTestCert creates a certificate signed by parent, or a self
+// signed ca if parent is nil.
+func newTestCert(t *testing.T, dir, cn string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{cn},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+		},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	c := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, cn+".crt"),
+		keyFile:  filepath.Join(dir, cn+".key"),
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	os.WriteFile(c.certFile, certPEM, 0o600)
+	os.WriteFile(c.keyFile, keyPEM, 0o600)
+	c.pair, _ = tls.X509KeyPair(certPEM, keyPEM)
+	return c
+}
@@ -0,0 +1,63 @@
+package tt
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// listenUnix listens on the socket file, replacing a stale one left
+// by a previous run. The socket file is removed when the listener is
+// closed.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s: %w", path, ErrNotSocket)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s: %w", path, ErrSocketInUse)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode == 0 {
+		mode = 0o660
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+var (
+	ErrNotSocket   = fmt.Errorf("not a socket")
+	ErrSocketInUse = fmt.Errorf("socket in use")
+)
+
+// PeerCred identifies the process connected over a unix socket.
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// peerCred returns credentials of the peer for unix socket
+// connections on supported platforms, nil otherwise.
+func peerCred(conn Connection) *PeerCred {
+	c, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	v, err := getPeerCred(c)
+	if err != nil {
+		return nil
+	}
+	return v
+}
@@ -0,0 +1,28 @@
+package tt
+
+import (
+	"net"
+	"syscall"
+)
+
+// getPeerCred uses SO_PEERCRED.
+func getPeerCred(c *net.UnixConn) (*PeerCred, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(
+			int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED,
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	return &PeerCred{PID: cred.Pid, UID: cred.Uid, GID: cred.Gid}, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package tt
+
+import (
+	"fmt"
+	"net"
+)
+
+func getPeerCred(c *net.UnixConn) (*PeerCred, error) {
+	return nil, fmt.Errorf("peer credentials not supported")
+}
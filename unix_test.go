@@ -0,0 +1,94 @@
+package tt
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gregoryv/mq"
+)
+
+func TestServer_UnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tt.sock")
+	// stale socket file from a previous run
+	if ln, err := net.Listen("unix", path); err == nil {
+		ln.(*net.UnixListener).SetUnlinkOnClose(false)
+		ln.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewServer()
+	s.AddBind(&Bind{
+		URL:           "unix://" + path,
+		AcceptTimeout: "10ms",
+		SocketMode:    0o600,
+	})
+	var cred *PeerCred
+	s.SetAuthenticator(AuthenticatorFunc(
+		func(_ context.Context, v *ConnectInfo) mq.ReasonCode {
+			cred = v.PeerCred
+			return mq.Success
+		},
+	))
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0o600 {
+		t.Errorf("mode %o", mode)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mq.NewConnect().WriteTo(conn)
+	if p, _ := mq.ReadPacket(conn); p == nil {
+		t.Fatal("no ConnAck")
+	}
+	conn.Close()
+	if runtime.GOOS == "linux" {
+		if cred == nil || cred.UID != uint32(os.Getuid()) || cred.PID != int32(os.Getpid()) {
+			t.Errorf("peer credentials %+v", cred)
+		}
+	}
+
+	cancel()
+	// socket file is removed on shutdown
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("socket file not removed")
+}
+
+func Test_listenUnix(t *testing.T) {
+	dir := t.TempDir()
+	{ // not a socket
+		path := filepath.Join(dir, "file")
+		os.WriteFile(path, nil, 0o600)
+		if _, err := listenUnix(path, 0); err == nil {
+			t.Error("replaced regular file")
+		}
+	}
+	{ // in use
+		path := filepath.Join(dir, "used.sock")
+		ln, err := listenUnix(path, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		if _, err := listenUnix(path, 0); err == nil {
+			t.Error("replaced socket in use")
+		}
+	}
+}
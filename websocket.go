@@ -0,0 +1,322 @@
+package tt
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wsListener accepts connections that are upgraded to WebSocket
+// during their handshake, see 6 Using WebSocket as a network
+// transport.
+type wsListener struct {
+	net.Listener
+	path string // empty accepts any
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newWSConn(conn, l.path), nil
+}
+
+// SetDeadline is used by connFeed.
+func (l *wsListener) SetDeadline(t time.Time) error {
+	if v, ok := l.Listener.(interface{ SetDeadline(time.Time) error }); ok {
+		return v.SetDeadline(t)
+	}
+	return nil
+}
+
+// newWSConn returns a server side WebSocket connection, which must
+// complete its handshake before use.
+func newWSConn(conn net.Conn, path string) *wsConn {
+	return &wsConn{
+		Conn: conn,
+		r:    bufio.NewReader(conn),
+		path: path,
+	}
+}
+
+// wsConn adapts binary WebSocket frames to a stream of bytes.
+type wsConn struct {
+	net.Conn
+	r    *bufio.Reader
+	path string
+
+	// true for the client side, which masks outgoing frames
+	client bool
+
+	// payload left of current frame
+	remaining uint64
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+
+	// sync frame writes
+	wm        sync.Mutex
+	closeOnce sync.Once
+}
+
+// HandshakeContext completes any tls handshake and upgrades the
+// connection from HTTP.
+func (c *wsConn) HandshakeContext(ctx context.Context) error {
+	if t, ok := c.Conn.(*tls.Conn); ok {
+		if err := t.HandshakeContext(ctx); err != nil {
+			return err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.Conn.SetDeadline(deadline)
+		defer c.Conn.SetDeadline(time.Time{})
+	}
+	r, err := http.ReadRequest(c.r)
+	if err != nil {
+		return err
+	}
+	if err := c.upgrade(r); err != nil {
+		fmt.Fprintf(c.Conn,
+			"HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n%v\n", err,
+		)
+		return err
+	}
+	_, err = fmt.Fprintf(c.Conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n"+
+		"Sec-WebSocket-Protocol: mqtt\r\n\r\n",
+		wsAccept(r.Header.Get("Sec-WebSocket-Key")),
+	)
+	return err
+}
+
+// upgrade checks the upgrade request, see RFC 6455 4.2.1
+func (c *wsConn) upgrade(r *http.Request) error {
+	switch {
+	case r.Method != http.MethodGet:
+		return fmt.Errorf("%w: method %s", ErrWebSocket, r.Method)
+	case c.path != "" && r.URL.Path != c.path:
+		return fmt.Errorf("%w: path %s", ErrWebSocket, r.URL.Path)
+	case !headerContains(r.Header, "Upgrade", "websocket"),
+		!headerContains(r.Header, "Connection", "upgrade"):
+		return fmt.Errorf("%w: not an upgrade", ErrWebSocket)
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		return fmt.Errorf("%w: unsupported version", ErrWebSocket)
+	case r.Header.Get("Sec-WebSocket-Key") == "":
+		return fmt.Errorf("%w: missing key", ErrWebSocket)
+	case !headerContains(r.Header, "Sec-WebSocket-Protocol", "mqtt"):
+		// 6.0.0-3 the server must select mqtt
+		return fmt.Errorf("%w: mqtt subprotocol not offered", ErrWebSocket)
+	}
+	return nil
+}
+
+var ErrWebSocket = fmt.Errorf("websocket")
+
+// Read fills p with payload of binary frames. Unlike io.Reader it
+// only returns early on error, as mq.ReadPacket expects the full
+// remaining length in one read.
+func (c *wsConn) Read(p []byte) (int, error) {
+	var n int
+	for n < len(p) {
+		if c.remaining == 0 {
+			if err := c.nextFrame(); err != nil {
+				return n, err
+			}
+			continue
+		}
+		max := len(p) - n
+		if uint64(max) > c.remaining {
+			max = int(c.remaining)
+		}
+		i, err := c.r.Read(p[n : n+max])
+		c.unmask(p[n : n+i])
+		n += i
+		c.remaining -= uint64(i)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// nextFrame reads frame headers until a data frame with payload is
+// found, control frames are handled here.
+func (c *wsConn) nextFrame() error {
+	// peek before discarding, so that a read deadline does not
+	// leave a partially read header
+	head, err := c.r.Peek(2)
+	if err != nil {
+		return err
+	}
+	opcode := head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	size := uint64(head[1] & 0x7f)
+	n := 2
+	switch size {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if masked {
+		n += 4
+	}
+	head, err = c.r.Peek(n)
+	if err != nil {
+		return err
+	}
+	switch size {
+	case 126:
+		size = uint64(binary.BigEndian.Uint16(head[2:]))
+	case 127:
+		size = binary.BigEndian.Uint64(head[2:])
+	}
+	c.masked = masked
+	c.maskPos = 0
+	if masked {
+		copy(c.mask[:], head[n-4:])
+	}
+	c.r.Discard(n)
+
+	// 5.1 clients must mask, servers must not
+	if masked == c.client {
+		c.writeClose(1002)
+		return fmt.Errorf("%w: bad masking", ErrWebSocket)
+	}
+
+	switch opcode {
+	case 0x0, 0x2: // continuation, binary
+		c.remaining = size
+
+	case 0x8: // close
+		c.writeClose(1000)
+		return io.EOF
+
+	case 0x9, 0xa: // ping, pong
+		if size > 125 {
+			return fmt.Errorf("%w: control frame too large", ErrWebSocket)
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		if opcode == 0x9 {
+			return c.writeFrame(0xa, payload)
+		}
+
+	default:
+		// 6.0.0-1 MQTT data must be sent in binary frames
+		c.writeClose(1003)
+		return fmt.Errorf("%w: unexpected opcode %v", ErrWebSocket, opcode)
+	}
+	return nil
+}
+
+func (c *wsConn) unmask(p []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range p {
+		p[i] ^= c.mask[c.maskPos%4]
+		c.maskPos++
+	}
+}
+
+// Write sends p in one binary frame.
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(0x2, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, p []byte) error {
+	c.wm.Lock()
+	defer c.wm.Unlock()
+
+	frame := make([]byte, 0, 14+len(p))
+	frame = append(frame, 0x80|opcode)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch size := len(p); {
+	case size <= 125:
+		frame = append(frame, maskBit|byte(size))
+	case size <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(size))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(size))
+	}
+	if !c.client {
+		frame = append(frame, p...)
+		_, err := c.Conn.Write(frame)
+		return err
+	}
+	var mask [4]byte
+	rand.Read(mask[:])
+	frame = append(frame, mask[:]...)
+	for i, b := range p {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *wsConn) writeClose(code uint16) {
+	c.closeOnce.Do(func() {
+		_ = c.writeFrame(0x8, binary.BigEndian.AppendUint16(nil, code))
+	})
+}
+
+// Close sends a close frame, if not already sent, and closes the
+// connection.
+func (c *wsConn) Close() error {
+	c.writeClose(1000)
+	return c.Conn.Close()
+}
+
+// ConnectionState returns the tls state of wss connections.
+func (c *wsConn) ConnectionState() tls.ConnectionState {
+	if t, ok := c.Conn.(*tls.Conn); ok {
+		return t.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// wsAccept returns the Sec-WebSocket-Accept value for the given key.
+func wsAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains returns true if the comma separated values of the
+// header contain v, case insensitive.
+func headerContains(h http.Header, key, v string) bool {
+	for _, line := range h.Values(key) {
+		for _, part := range strings.Split(line, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), v) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package tt
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gregoryv/mq"
+)
+
+func TestServer_WebSocket(t *testing.T) {
+	ln, _ := net.Listen("tcp", "localhost:")
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	s.AddBind(&Bind{URL: "ws://" + addr + "/mqtt", AcceptTimeout: "10ms"})
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	conn, err := dialWebSocket(addr, "/mqtt", "mqtt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	p := mq.NewConnect()
+	p.SetClientID("pink")
+	p.WriteTo(conn)
+	if a, _ := mq.ReadPacket(conn); a == nil {
+		t.Fatal("no ConnAck")
+	}
+	// payload larger than a small frame
+	sub := mq.NewSubscribe()
+	sub.SetPacketID(1)
+	sub.AddFilters(mq.NewTopicFilter("a/b", 0))
+	sub.WriteTo(conn)
+	_, _ = mq.ReadPacket(conn)
+
+	payload := strings.Repeat("x", 70000)
+	mq.Pub(0, "a/b", payload).WriteTo(conn)
+	got, err := mq.ReadPacket(conn)
+	if p, ok := got.(*mq.Publish); !ok || string(p.Payload()) != payload {
+		t.Fatal("unexpected", got, err)
+	}
+
+	{ // ping frames are answered
+		conn.writeFrame(0x9, []byte("hello"))
+		mq.NewPingReq().WriteTo(conn)
+		if p, _ := mq.ReadPacket(conn); p == nil {
+			t.Error("no PingResp")
+		}
+	}
+
+	{ // subprotocol mqtt is required
+		_, err := dialWebSocket(addr, "/mqtt", "chat")
+		if err == nil {
+			t.Error("upgraded without mqtt subprotocol")
+		}
+	}
+	{ // wrong path
+		_, err := dialWebSocket(addr, "/other", "mqtt")
+		if err == nil {
+			t.Error("upgraded on wrong path")
+		}
+	}
+}
+
+func Test_wsAccept(t *testing.T) {
+	// RFC 6455 1.3
+	got := wsAccept("dGhlIHNhbXBsZSBub25jZQ==")
+	if exp := "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != exp {
+		t.Errorf("got %s, expected %s", got, exp)
+	}
+}
+
+// dialWebSocket returns the client side of an upgraded connection.
+func dialWebSocket(addr, path, protocol string) (*wsConn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\n"+
+		"Sec-WebSocket-Protocol: %s\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n",
+		path, addr, key, protocol,
+	)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		conn.Close()
+		return nil, fmt.Errorf("upgrade failed: %s", resp.Status)
+	}
+	return &wsConn{Conn: conn, r: r, client: true}, nil
+}
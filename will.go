@@ -0,0 +1,134 @@
+package tt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/gregoryv/mq"
+)
+
+// willOf returns the will message and Will Delay Interval in seconds
+// of the connect packet. Returns nil if no will is set.
+//
+// mq.Connect.Will does not carry the payload, nor the retain flag,
+// after being read from the wire and the delay interval is not
+// exposed. Both are read from the wire format instead.
+//
+// See 3.1.3.2 Will Properties
+func willOf(p *mq.Connect) (*mq.Publish, uint32, error) {
+	if !p.HasFlag(mq.WillFlag) || p.Will() == nil {
+		return nil, 0, nil
+	}
+	var buf bytes.Buffer
+	p.WriteTo(&buf)
+	r := wireReader{data: buf.Bytes()}
+
+	r.byte()          // fixed header
+	r.vbint()         // remaining length
+	r.binary()        // protocol name
+	r.skip(1 + 1)     // protocol version and flags
+	r.skip(2)         // keep alive
+	r.skip(r.vbint()) // properties
+	r.binary()        // client id
+
+	// will properties
+	var delay uint32
+	end := r.i + r.vbint()
+	for r.err == nil && r.i < end {
+		switch id := mq.Ident(r.byte()); id {
+		case mq.WillDelayInterval:
+			delay = r.uint32()
+		case mq.PayloadFormatIndicator:
+			r.skip(1)
+		case mq.MessageExpiryInterval:
+			r.skip(4)
+		case mq.ContentType, mq.ResponseTopic, mq.CorrelationData:
+			r.binary()
+		case mq.UserProperty:
+			r.binary()
+			r.binary()
+		default:
+			r.err = fmt.Errorf("will property 0x%02x", byte(id))
+		}
+	}
+	r.binary() // will topic
+	payload := r.binary()
+	if r.err != nil {
+		return nil, 0, r.err
+	}
+
+	will := copyPublish(p.Will())
+	will.SetPayload(payload)
+	will.SetRetain(p.HasFlag(mq.WillRetain))
+	return will, delay, nil
+}
+
+// wireReader reads mqtt wire types, the first failure is kept in
+// err.
+type wireReader struct {
+	data []byte
+	i    int
+	err  error
+}
+
+func (r *wireReader) skip(n int) {
+	if r.err != nil {
+		return
+	}
+	if r.i+n > len(r.data) {
+		r.err = ErrShortData
+		return
+	}
+	r.i += n
+}
+
+func (r *wireReader) byte() byte {
+	r.skip(1)
+	if r.err != nil {
+		return 0
+	}
+	return r.data[r.i-1]
+}
+
+func (r *wireReader) uint32() uint32 {
+	r.skip(4)
+	if r.err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(r.data[r.i-4:])
+}
+
+// binary reads two byte length prefixed data, also used for strings.
+func (r *wireReader) binary() []byte {
+	r.skip(2)
+	if r.err != nil {
+		return nil
+	}
+	n := int(binary.BigEndian.Uint16(r.data[r.i-2:]))
+	r.skip(n)
+	if r.err != nil {
+		return nil
+	}
+	return r.data[r.i-n : r.i]
+}
+
+// vbint reads a variable byte integer.
+func (r *wireReader) vbint() int {
+	var v, multiplier int = 0, 1
+	for i := 0; i < 4; i++ {
+		b := r.byte()
+		if r.err != nil {
+			return 0
+		}
+		v += int(b&127) * multiplier
+		if b&128 == 0 {
+			return v
+		}
+		multiplier *= 128
+	}
+	r.err = fmt.Errorf("variable byte integer too long")
+	return 0
+}
+
+var ErrShortData = fmt.Errorf("short data")
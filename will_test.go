@@ -0,0 +1,219 @@
+package tt
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gregoryv/mq"
+)
+
+func Test_willOf(t *testing.T) {
+	w := mq.Pub(1, "gopher/gone", "bye")
+	w.SetRetain(true)
+	w.SetContentType("text/plain")
+	w.AddUserProp("a", "b")
+	c := mq.NewConnect()
+	c.SetWill(w, 30)
+
+	// read from wire, as in server
+	var buf bytes.Buffer
+	c.WriteTo(&buf)
+	p, _ := mq.ReadPacket(&buf)
+
+	will, delay, err := willOf(p.(*mq.Connect))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delay != 30 {
+		t.Error("delay", delay)
+	}
+	if v := string(will.Payload()); v != "bye" {
+		t.Error("payload", v)
+	}
+	if !will.Retain() || will.QoS() != 1 || will.TopicName() != "gopher/gone" {
+		t.Error("will", will)
+	}
+
+	// without will
+	if will, _, _ := willOf(mq.NewConnect()); will != nil {
+		t.Error("unexpected will", will)
+	}
+}
+
+// Will is published if the client disconnects without Disconnect or
+// with reason DisconnectWithWill, but not on a normal disconnect.
+func TestServer_Will(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	sub := pipeConn(ctx, s)
+	t.Cleanup(func() { sub.Close() })
+	{
+		mq.NewConnect().WriteTo(sub)
+		_, _ = mq.ReadPacket(sub)
+		p := mq.NewSubscribe()
+		p.SetPacketID(1)
+		p.AddFilters(mq.NewTopicFilter("will/#", mq.OptQoS1))
+		p.WriteTo(sub)
+		_, _ = mq.ReadPacket(sub)
+	}
+
+	connectWithWill := func(topic string) *mq.Connect {
+		c := mq.NewConnect()
+		c.SetWill(mq.Pub(0, topic, "bye"), 0)
+		return c
+	}
+	expectWill := func(topic string) {
+		t.Helper()
+		p, _ := mq.ReadPacket(sub)
+		if p, ok := p.(*mq.Publish); !ok || p.TopicName() != topic {
+			t.Fatalf("expected will on %s, got %v", topic, p)
+		}
+	}
+
+	{ // normal disconnect, no will
+		conn := pipeConn(ctx, s)
+		connectWithWill("will/normal").WriteTo(conn)
+		_, _ = mq.ReadPacket(conn)
+		mq.NewDisconnect().WriteTo(conn)
+	}
+	{ // dropped connection
+		conn := pipeConn(ctx, s)
+		connectWithWill("will/dropped").WriteTo(conn)
+		_, _ = mq.ReadPacket(conn)
+		conn.Close()
+		expectWill("will/dropped")
+	}
+	{ // disconnect with will
+		conn := pipeConn(ctx, s)
+		connectWithWill("will/requested").WriteTo(conn)
+		_, _ = mq.ReadPacket(conn)
+		d := mq.NewDisconnect()
+		d.SetReasonCode(mq.DisconnectWithWill)
+		d.WriteTo(conn)
+		expectWill("will/requested")
+	}
+}
+
+// A delayed will of a durable session is sent after the delay unless
+// the session is resumed.
+func TestServer_WillDelay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	sub := pipeConn(ctx, s)
+	t.Cleanup(func() { sub.Close() })
+	{
+		mq.NewConnect().WriteTo(sub)
+		_, _ = mq.ReadPacket(sub)
+		p := mq.NewSubscribe()
+		p.SetPacketID(1)
+		p.AddFilters(mq.NewTopicFilter("will/#", 0))
+		p.WriteTo(sub)
+		_, _ = mq.ReadPacket(sub)
+	}
+	connect := func(id, topic string) net.Conn {
+		conn := pipeConn(ctx, s)
+		t.Cleanup(func() { conn.Close() })
+		c := mq.NewConnect()
+		c.SetClientID(id)
+		c.SetSessionExpiryInterval(60)
+		if topic != "" {
+			c.SetWill(mq.Pub(0, topic, "bye"), 1)
+		}
+		c.WriteTo(conn)
+		_, _ = mq.ReadPacket(conn)
+		return conn
+	}
+	connect("resumed", "will/resumed").Close()
+	connect("dropped", "will/dropped").Close()
+	start := time.Now()
+	connect("resumed", "")
+
+	sub.SetReadDeadline(time.Now().Add(3 * time.Second))
+	p, err := mq.ReadPacket(sub)
+	if err != nil {
+		t.Fatal("will not sent", err)
+	}
+	if p, ok := p.(*mq.Publish); !ok || p.TopicName() != "will/dropped" {
+		t.Fatal("expected will/dropped got", p)
+	}
+	if d := time.Since(start); d < 900*time.Millisecond {
+		t.Error("will sent before delay", d)
+	}
+	mq.NewPingReq().WriteTo(sub)
+	if p, _ := mq.ReadPacket(sub); !isPingResp(p) {
+		t.Error("will of resumed session sent", p)
+	}
+}
+
+// A delayed will is sent right away when a Clean Start takeover
+// ends the session.
+func TestServer_WillDelayCleanStart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewServer()
+	go s.Run(ctx)
+	<-s.Events() // running
+
+	sub := pipeConn(ctx, s)
+	t.Cleanup(func() { sub.Close() })
+	{
+		mq.NewConnect().WriteTo(sub)
+		_, _ = mq.ReadPacket(sub)
+		p := mq.NewSubscribe()
+		p.SetPacketID(1)
+		p.AddFilters(mq.NewTopicFilter("will/#", 0))
+		p.WriteTo(sub)
+		_, _ = mq.ReadPacket(sub)
+	}
+	old := pipeConn(ctx, s)
+	t.Cleanup(func() { old.Close() })
+	{
+		c := mq.NewConnect()
+		c.SetClientID("gopher")
+		c.SetSessionExpiryInterval(60)
+		c.SetWill(mq.Pub(0, "will/gopher", "bye"), 60)
+		c.WriteTo(old)
+		_, _ = mq.ReadPacket(old)
+	}
+	conn := pipeConn(ctx, s)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		c := mq.NewConnect()
+		c.SetClientID("gopher")
+		c.SetCleanStart(true)
+		c.WriteTo(conn)
+		_, _ = mq.ReadPacket(conn)
+	}()
+	_, _ = mq.ReadPacket(old) // Disconnect SessionTakenOver
+
+	sub.SetReadDeadline(time.Now().Add(time.Second))
+	p, err := mq.ReadPacket(sub)
+	if err != nil {
+		t.Fatal("will not sent", err)
+	}
+	if p, ok := p.(*mq.Publish); !ok || p.TopicName() != "will/gopher" {
+		t.Fatal("expected will/gopher got", p)
+	}
+}
+
+func Test_session_cancelWill(t *testing.T) {
+	s := newSessions(newRouter())
+	sess := s.newSession("a")
+	var sent bool
+	sess.delayWill(nil, time.Minute, func() { sent = true })
+	sess.cancelWill(true)
+	if sent {
+		t.Error("will sent though dropped")
+	}
+}